@@ -156,26 +156,17 @@ async function uploadVideoFile(videoID) {
   const videoFile = document.getElementById('video-file').files[0];
   if (!videoFile) return;
 
-  const formData = new FormData();
-  formData.append('video', videoFile);
-
   uploadBtnSelector = 'upload-video-btn';
   setUploadButtonState(true, uploadBtnSelector);
 
   try {
-    const res = await fetch(`/api/video_upload/${videoID}`, {
-      method: 'POST',
-      headers: {
-        Authorization: `Bearer ${localStorage.getItem('token')}`,
-      },
-      body: formData,
-    });
-    if (!res.ok) {
-      const data = await res.json();
-      throw new Error(`Failed to upload video file. Error: ${data.error}`);
+    const uploadedDirectly = await uploadVideoDirect(videoID, videoFile);
+    if (!uploadedDirectly) {
+      await uploadVideoThroughServer(videoID, videoFile);
     }
 
     console.log('Video uploaded!');
+    await waitForProcessing(videoID);
     await getVideo(videoID);
   } catch (error) {
     alert(`Error: ${error.message}`);
@@ -184,6 +175,160 @@ async function uploadVideoFile(videoID) {
   setUploadButtonState(false, uploadBtnSelector);
 }
 
+// Videos are processed in the background after upload; follow the video's
+// event stream until processing settles so the player shows the processed
+// file. Falls back to polling if the stream can't be opened.
+async function waitForProcessing(videoID) {
+  const uploadBtn = document.getElementById('upload-video-btn');
+  uploadBtn.textContent = 'Processing...';
+
+  const res = await fetch(`/api/videos/${videoID}/events`, {
+    headers: {
+      Authorization: `Bearer ${localStorage.getItem('token')}`,
+    },
+  });
+  if (!res.ok || !res.body) {
+    return pollProcessing(videoID);
+  }
+
+  // EventSource can't send the Authorization header, so parse the stream
+  // ourselves: events are separated by a blank line.
+  const reader = res.body.pipeThrough(new TextDecoderStream()).getReader();
+  let buffer = '';
+  try {
+    while (true) {
+      const { value, done } = await reader.read();
+      if (done) {
+        return pollProcessing(videoID);
+      }
+      buffer += value;
+      let end;
+      while ((end = buffer.indexOf('\n\n')) !== -1) {
+        const block = buffer.slice(0, end);
+        buffer = buffer.slice(end + 2);
+        const data = block
+          .split('\n')
+          .filter((line) => line.startsWith('data: '))
+          .map((line) => line.slice(6))
+          .join('\n');
+        if (!data) {
+          continue;
+        }
+        const event = JSON.parse(data);
+        if (event.type === 'done') {
+          return;
+        }
+        if (event.type === 'failed') {
+          throw new Error(`Video processing failed: ${event.error}`);
+        }
+        uploadBtn.textContent = describeVideoEvent(event);
+      }
+    }
+  } finally {
+    reader.cancel();
+  }
+}
+
+function describeVideoEvent(event) {
+  switch (event.type) {
+    case 'upload-received':
+      return 'Upload received...';
+    case 'probing':
+      return 'Checking video...';
+    case 'queued':
+      return 'Waiting to be processed...';
+    case 'transcoding':
+      return `Transcoding ${event.stage} ${Math.floor(event.percent)}%...`;
+    case 'uploading':
+      return 'Saving...';
+    case 'retrying':
+      return 'Retrying...';
+    default:
+      return 'Processing...';
+  }
+}
+
+async function pollProcessing(videoID) {
+  while (true) {
+    const res = await fetch(`/api/videos/${videoID}/processing`, {
+      headers: {
+        Authorization: `Bearer ${localStorage.getItem('token')}`,
+      },
+    });
+    const job = await res.json();
+    if (!res.ok) {
+      throw new Error(`Failed to get processing status. Error: ${job.error}`);
+    }
+    if (job.status === 'done') {
+      return;
+    }
+    if (job.status === 'failed') {
+      throw new Error(`Video processing failed: ${job.last_error}`);
+    }
+    await new Promise((resolve) => setTimeout(resolve, 2000));
+  }
+}
+
+// Uploads straight to storage with a presigned URL. Returns false when the
+// server's storage backend doesn't support it, so the caller can fall back.
+async function uploadVideoDirect(videoID, videoFile) {
+  const presignRes = await fetch(`/api/video_upload/${videoID}/presign`, {
+    method: 'POST',
+    headers: {
+      'Content-Type': 'application/json',
+      Authorization: `Bearer ${localStorage.getItem('token')}`,
+    },
+    body: JSON.stringify({ content_type: videoFile.type }),
+  });
+  if (presignRes.status === 501) {
+    return false;
+  }
+  const presign = await presignRes.json();
+  if (!presignRes.ok) {
+    throw new Error(`Failed to start upload. Error: ${presign.error}`);
+  }
+
+  const putRes = await fetch(presign.upload_url, {
+    method: presign.method,
+    headers: presign.headers,
+    body: videoFile,
+  });
+  if (!putRes.ok) {
+    throw new Error(`Failed to upload video file to storage (${putRes.status})`);
+  }
+
+  const completeRes = await fetch(`/api/video_upload/${videoID}/complete`, {
+    method: 'POST',
+    headers: {
+      'Content-Type': 'application/json',
+      Authorization: `Bearer ${localStorage.getItem('token')}`,
+    },
+    body: JSON.stringify({ key: presign.key }),
+  });
+  if (!completeRes.ok) {
+    const data = await completeRes.json();
+    throw new Error(`Failed to process video file. Error: ${data.error}`);
+  }
+  return true;
+}
+
+async function uploadVideoThroughServer(videoID, videoFile) {
+  const formData = new FormData();
+  formData.append('video', videoFile);
+
+  const res = await fetch(`/api/video_upload/${videoID}`, {
+    method: 'POST',
+    headers: {
+      Authorization: `Bearer ${localStorage.getItem('token')}`,
+    },
+    body: formData,
+  });
+  if (!res.ok) {
+    const data = await res.json();
+    throw new Error(`Failed to upload video file. Error: ${data.error}`);
+  }
+}
+
 const videoStateHandler = createVideoStateHandler();
 
 async function getVideos() {
@@ -1,7 +1,12 @@
 package main
 
 import (
+	"errors"
+	"io"
+	"net/http"
 	"os"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
 )
 
 func (cfg apiConfig) ensureAssetsDir() error {
@@ -10,3 +15,40 @@ func (cfg apiConfig) ensureAssetsDir() error {
 	}
 	return nil
 }
+
+func (cfg apiConfig) ensureUploadsDir() error {
+	return os.MkdirAll(cfg.uploadsRoot, 0755)
+}
+
+// storageHandler serves objects straight out of a storage backend, for
+// backends that have no directory http.FileServer could point at.
+func storageHandler(store storage.Storage) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.URL.Path
+		info, err := store.Stat(r.Context(), key)
+		if errors.Is(err, storage.ErrNotFound) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Couldn't read object", http.StatusInternalServerError)
+			return
+		}
+
+		body, err := store.Get(r.Context(), key)
+		if err != nil {
+			http.Error(w, "Couldn't read object", http.StatusInternalServerError)
+			return
+		}
+		defer body.Close()
+
+		if info.ContentType != "" {
+			w.Header().Set("Content-Type", info.ContentType)
+		}
+		if seeker, ok := body.(io.ReadSeeker); ok {
+			http.ServeContent(w, r, "", info.LastModified, seeker)
+			return
+		}
+		io.Copy(w, body)
+	})
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+	"github.com/google/uuid"
+)
+
+const captionUploadLimit = 2 << 20 // 2 MB
+
+var (
+	errInvalidCaptions = errors.New("invalid captions")
+	// captionLanguagePattern loosely follows BCP 47: a language, then
+	// optional script, region and variant subtags.
+	captionLanguagePattern = regexp.MustCompile(`^[a-zA-Z]{2,3}(-[a-zA-Z0-9]{2,8})*$`)
+	// Hours are optional in WebVTT and the fraction separator is a comma in
+	// SRT; both are accepted either way.
+	captionTimestampPattern = regexp.MustCompile(`^(?:(\d{1,}):)?(\d{2}):(\d{2})[.,](\d{3})$`)
+)
+
+// captionsPrefix holds everything of a video's captions. Unlike derived
+// media, captions belong to the one video and aren't shared through blobs.
+func captionsPrefix(videoID uuid.UUID) string {
+	return "captions/" + videoID.String() + "/"
+}
+
+// captionsHLSPrefix holds the video's own HLS master playlist, which adds
+// its captions to the renditions shared through the blob.
+func captionsHLSPrefix(videoID uuid.UUID) string {
+	return captionsPrefix(videoID) + "hls/"
+}
+
+type captionCue struct {
+	id       string
+	start    float64
+	end      float64
+	settings string
+	text     []string
+}
+
+// parseCaptions validates a WebVTT or SRT file, told apart by the WebVTT
+// signature, and returns it as WebVTT. SRT is converted; WebVTT is kept as
+// it is apart from line endings, so styling and regions survive. Every cue
+// has to end after it starts and cues have to be in order.
+func parseCaptions(data []byte) ([]byte, error) {
+	text := string(bytes.TrimPrefix(data, []byte("\ufeff")))
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	text = strings.ReplaceAll(text, "\r", "\n")
+	blocks := splitCaptionBlocks(text)
+
+	if len(blocks) > 0 && isWebVTTHeader(blocks[0][0]) {
+		_, err := parseCaptionCues(blocks[1:], false)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(strings.TrimRight(text, "\n") + "\n"), nil
+	}
+
+	cues, err := parseCaptionCues(blocks, true)
+	if err != nil {
+		return nil, err
+	}
+	return buildWebVTT(cues), nil
+}
+
+func isWebVTTHeader(line string) bool {
+	rest, ok := strings.CutPrefix(line, "WEBVTT")
+	return ok && (rest == "" || rest[0] == ' ' || rest[0] == '\t')
+}
+
+// splitCaptionBlocks splits on blank lines; blocks are never empty.
+func splitCaptionBlocks(text string) [][]string {
+	blocks := [][]string{}
+	var block []string
+	for _, line := range strings.Split(text, "\n") {
+		if strings.TrimSpace(line) == "" {
+			if len(block) > 0 {
+				blocks = append(blocks, block)
+				block = nil
+			}
+			continue
+		}
+		block = append(block, line)
+	}
+	if len(block) > 0 {
+		blocks = append(blocks, block)
+	}
+	return blocks
+}
+
+// parseCaptionCues reads the cue blocks of a file. In SRT the identifier is
+// the cue's number; in WebVTT NOTE, STYLE and REGION blocks are skipped.
+func parseCaptionCues(blocks [][]string, srt bool) ([]captionCue, error) {
+	cues := []captionCue{}
+	for _, block := range blocks {
+		if !srt && (isVTTBlock(block[0], "NOTE") || isVTTBlock(block[0], "STYLE") || isVTTBlock(block[0], "REGION")) {
+			continue
+		}
+		cue := captionCue{}
+		timing := block[0]
+		text := block[1:]
+		if !strings.Contains(timing, "-->") {
+			if len(block) < 2 {
+				return nil, fmt.Errorf("%w: cue %d has no timing", errInvalidCaptions, len(cues)+1)
+			}
+			cue.id = block[0]
+			timing, text = block[1], block[2:]
+		}
+
+		startText, rest, _ := strings.Cut(timing, "-->")
+		fields := strings.Fields(rest)
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("%w: cue %d has no end time", errInvalidCaptions, len(cues)+1)
+		}
+		var err error
+		cue.start, err = parseCaptionTimestamp(strings.TrimSpace(startText))
+		if err != nil {
+			return nil, fmt.Errorf("%w: cue %d: %v", errInvalidCaptions, len(cues)+1, err)
+		}
+		cue.end, err = parseCaptionTimestamp(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("%w: cue %d: %v", errInvalidCaptions, len(cues)+1, err)
+		}
+		// SRT has no cue settings, only the odd player's X1:.. coordinates.
+		if !srt {
+			cue.settings = strings.Join(fields[1:], " ")
+		}
+		if cue.end <= cue.start {
+			return nil, fmt.Errorf("%w: cue %d ends before it starts", errInvalidCaptions, len(cues)+1)
+		}
+		if len(cues) > 0 && cue.start < cues[len(cues)-1].start {
+			return nil, fmt.Errorf("%w: cue %d starts before the cue before it", errInvalidCaptions, len(cues)+1)
+		}
+		for _, line := range text {
+			if strings.Contains(line, "-->") {
+				return nil, fmt.Errorf("%w: cue %d has a timing line in its text", errInvalidCaptions, len(cues)+1)
+			}
+		}
+		cue.text = text
+		cues = append(cues, cue)
+	}
+	if len(cues) == 0 {
+		return nil, fmt.Errorf("%w: no cues found", errInvalidCaptions)
+	}
+	return cues, nil
+}
+
+func isVTTBlock(line, keyword string) bool {
+	rest, ok := strings.CutPrefix(line, keyword)
+	return ok && (rest == "" || rest[0] == ' ' || rest[0] == '\t')
+}
+
+func parseCaptionTimestamp(s string) (float64, error) {
+	match := captionTimestampPattern.FindStringSubmatch(s)
+	if match == nil {
+		return 0, fmt.Errorf("bad timestamp %q", s)
+	}
+	var hours int
+	if match[1] != "" {
+		hours, _ = strconv.Atoi(match[1])
+	}
+	minutes, _ := strconv.Atoi(match[2])
+	seconds, _ := strconv.Atoi(match[3])
+	millis, _ := strconv.Atoi(match[4])
+	if minutes > 59 || seconds > 59 {
+		return 0, fmt.Errorf("bad timestamp %q", s)
+	}
+	return float64(hours*3600+minutes*60+seconds) + float64(millis)/1000, nil
+}
+
+func buildWebVTT(cues []captionCue) []byte {
+	var b strings.Builder
+	b.WriteString("WEBVTT\n")
+	for _, cue := range cues {
+		b.WriteString("\n")
+		if cue.id != "" {
+			b.WriteString(cue.id + "\n")
+		}
+		fmt.Fprintf(&b, "%s --> %s", vttTimestamp(cue.start), vttTimestamp(cue.end))
+		if cue.settings != "" {
+			b.WriteString(" " + cue.settings)
+		}
+		b.WriteString("\n")
+		for _, line := range cue.text {
+			b.WriteString(line + "\n")
+		}
+	}
+	return []byte(b.String())
+}
+
+// putCaptionFile stores a WebVTT file under the video's captions prefix,
+// with a new name every time so nothing serves a cached old version.
+func (cfg *apiConfig) putCaptionFile(ctx context.Context, videoID uuid.UUID, vtt []byte) (string, error) {
+	randomBytes := make([]byte, 16)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", fmt.Errorf("error creating random filename: %w", err)
+	}
+	key := captionsPrefix(videoID) + hex.EncodeToString(randomBytes) + ".vtt"
+	err = cfg.storage.Put(ctx, key, bytes.NewReader(vtt), storage.PutOptions{ContentType: "text/vtt"})
+	if err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+// captionMediaRelease releases a caption file and whatever else is listed
+// with it. Captions aren't in blobs, so they're deleted straight away.
+func captionMediaRelease(key string, with ...string) []database.MediaRelease {
+	release := database.MediaRelease{Key: key}
+	for _, deleted := range append([]string{key}, with...) {
+		release.Deletions = append(release.Deletions, database.StorageDeletionParams{Key: deleted})
+	}
+	return []database.MediaRelease{release}
+}
+
+func captionPlaylistKey(caption database.Caption) string {
+	return captionsHLSPrefix(caption.VideoID) + caption.ID.String() + ".m3u8"
+}
+
+// sharedHLSMaster is the key of the master playlist packaged with the
+// video's renditions.
+func (cfg *apiConfig) sharedHLSMaster(video database.Video) (string, bool) {
+	if video.VideoURL == nil {
+		return "", false
+	}
+	videoKey, ok := cfg.objectKey(*video.VideoURL)
+	if !ok {
+		return "", false
+	}
+	return videoMediaPrefix(videoKey) + "hls/" + hlsMasterPlaylist, true
+}
+
+// publishCaptionsHLS brings the video's HLS master playlist in line with
+// its captions. The master packaged with the renditions is shared by every
+// video with the same upload, so a video with captions gets a master of
+// its own under captionsHLSPrefix: the shared one plus a SUBTITLES group.
+// Renditions are referred to relative to the storage root, which keeps the
+// playlists independent of how URLs are handed out. Videos without HLS are
+// left alone.
+//
+// video may be stale. If its HLS playlist turns out to have been replaced
+// in the meantime, by processing or another caption change, the video is
+// read again and the master rebuilt on the new one.
+func (cfg *apiConfig) publishCaptionsHLS(ctx context.Context, video database.Video) (database.Video, error) {
+	const attempts = 3
+	for i := 1; ; i++ {
+		published, err := cfg.tryPublishCaptionsHLS(ctx, video)
+		if !errors.Is(err, database.ErrVideoChanged) || i == attempts {
+			return published, err
+		}
+		video, err = cfg.db.GetVideo(video.ID)
+		if err != nil {
+			return video, err
+		}
+		if video.ID == uuid.Nil {
+			return video, nil
+		}
+	}
+}
+
+func (cfg *apiConfig) tryPublishCaptionsHLS(ctx context.Context, video database.Video) (database.Video, error) {
+	if video.VideoURL == nil || video.HLSURL == nil {
+		return video, nil
+	}
+	sharedMaster, ok := cfg.sharedHLSMaster(video)
+	if !ok {
+		return video, nil
+	}
+	ownMaster := captionsHLSPrefix(video.ID) + hlsMasterPlaylist
+
+	captions, err := cfg.db.GetCaptions(video.ID)
+	if err != nil {
+		return video, err
+	}
+	if len(captions) == 0 {
+		if *video.HLSURL == sharedMaster {
+			return video, nil
+		}
+		err = cfg.db.SetVideoHLSURL(video.ID, video.HLSURL, &sharedMaster, []database.MediaRelease{{
+			Key:       captionsHLSPrefix(video.ID),
+			Deletions: []database.StorageDeletionParams{{Key: captionsHLSPrefix(video.ID), Prefix: true}},
+		}})
+		if err != nil {
+			return video, err
+		}
+		video.HLSURL = &sharedMaster
+		cfg.storageCleanup.notify()
+		return video, nil
+	}
+
+	body, err := cfg.storage.Get(ctx, sharedMaster)
+	if errors.Is(err, storage.ErrNotFound) {
+		// Packaged before masters lived there, nothing to build on.
+		return video, nil
+	}
+	if err != nil {
+		return video, err
+	}
+	shared, err := io.ReadAll(body)
+	body.Close()
+	if err != nil {
+		return video, err
+	}
+
+	duration := 0.0
+	if video.DurationSeconds != nil {
+		duration = *video.DurationSeconds
+	}
+	for _, caption := range captions {
+		playlist := buildSubtitlePlaylist(relativeKey(captionsHLSPrefix(video.ID), caption.URL), duration)
+		err := cfg.storage.Put(ctx, captionPlaylistKey(caption), strings.NewReader(playlist), storage.PutOptions{
+			ContentType: contentTypeForFile(".m3u8"),
+		})
+		if err != nil {
+			return video, err
+		}
+	}
+	master := buildCaptionedMasterPlaylist(string(shared), path.Dir(sharedMaster)+"/", captionsHLSPrefix(video.ID), captions)
+	err = cfg.storage.Put(ctx, ownMaster, strings.NewReader(master), storage.PutOptions{
+		ContentType: contentTypeForFile(hlsMasterPlaylist),
+	})
+	if err != nil {
+		return video, err
+	}
+
+	// Even if the video already points here, check that the master just
+	// written was built on the playlist it still has.
+	err = cfg.db.SetVideoHLSURL(video.ID, video.HLSURL, &ownMaster, nil)
+	if err != nil {
+		return video, err
+	}
+	video.HLSURL = &ownMaster
+	return video, nil
+}
+
+// buildCaptionedMasterPlaylist rewrites the shared master, which lives in
+// sharedDir, to live in ownDir and offer captions as subtitles.
+func buildCaptionedMasterPlaylist(shared, sharedDir, ownDir string, captions []database.Caption) string {
+	var b strings.Builder
+	for _, line := range strings.Split(strings.TrimSpace(shared), "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "#EXT-X-STREAM-INF:"):
+			b.WriteString(line + ",SUBTITLES=\"subs\"\n")
+		case line == "" || strings.HasPrefix(line, "#"):
+			b.WriteString(line + "\n")
+			if strings.HasPrefix(line, "#EXT-X-VERSION:") {
+				for _, caption := range captions {
+					fmt.Fprintf(&b, "#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID=\"subs\",NAME=\"%s\",LANGUAGE=\"%s\",AUTOSELECT=YES,DEFAULT=NO,URI=\"%s.m3u8\"\n",
+						hlsQuotedString(caption.Label), caption.Language, caption.ID)
+				}
+			}
+		default:
+			b.WriteString(relativeKey(ownDir, sharedDir+line) + "\n")
+		}
+	}
+	return b.String()
+}
+
+// hlsQuotedString makes s fit in a playlist attribute's quoted string,
+// which can't hold double quotes or line breaks and has no escapes.
+func hlsQuotedString(s string) string {
+	return strings.NewReplacer("\"", "'", "\r", " ", "\n", " ").Replace(s)
+}
+
+// buildSubtitlePlaylist is a media playlist with the whole WebVTT file as
+// its one segment.
+func buildSubtitlePlaylist(uri string, duration float64) string {
+	targetDuration := max(1, int(math.Ceil(duration)))
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	b.WriteString("#EXT-X-VERSION:3\n")
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", targetDuration)
+	b.WriteString("#EXT-X-MEDIA-SEQUENCE:0\n")
+	b.WriteString("#EXT-X-PLAYLIST-TYPE:VOD\n")
+	fmt.Fprintf(&b, "#EXTINF:%.3f,\n", max(duration, 1))
+	b.WriteString(uri + "\n")
+	b.WriteString("#EXT-X-ENDLIST\n")
+	return b.String()
+}
+
+// relativeKey is key relative to the directory dir, both from the storage
+// root, for playlists to refer to each other.
+func relativeKey(dir, key string) string {
+	dirParts := strings.Split(strings.TrimSuffix(dir, "/"), "/")
+	keyParts := strings.Split(key, "/")
+	common := 0
+	for common < len(dirParts) && common < len(keyParts)-1 && dirParts[common] == keyParts[common] {
+		common++
+	}
+	return strings.Repeat("../", len(dirParts)-common) + strings.Join(keyParts[common:], "/")
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseCaptionsConvertsSRT(t *testing.T) {
+	srt := "\ufeff1\r\n" +
+		"00:00:01,000 --> 00:00:02,500\r\n" +
+		"Hello\r\n" +
+		"<i>world</i>\r\n" +
+		"\r\n" +
+		"2\r\n" +
+		"00:01:02,050 --> 01:00:00,000 X1:10 X2:20 Y1:30 Y2:40\r\n" +
+		"Second\r\n"
+	want := "WEBVTT\n" +
+		"\n" +
+		"1\n" +
+		"00:00:01.000 --> 00:00:02.500\n" +
+		"Hello\n" +
+		"<i>world</i>\n" +
+		"\n" +
+		"2\n" +
+		"00:01:02.050 --> 01:00:00.000\n" +
+		"Second\n"
+
+	got, err := parseCaptions([]byte(srt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("parseCaptions =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestParseCaptionsKeepsWebVTT(t *testing.T) {
+	vtt := "WEBVTT - Example\r\n" +
+		"\r\n" +
+		"STYLE\r\n" +
+		"::cue { color: yellow }\r\n" +
+		"\r\n" +
+		"NOTE a comment\r\n" +
+		"\r\n" +
+		"00:01.000 --> 00:02.000 align:start line:0\r\n" +
+		"Short timestamps\r\n" +
+		"\r\n"
+	want := "WEBVTT - Example\n" +
+		"\n" +
+		"STYLE\n" +
+		"::cue { color: yellow }\n" +
+		"\n" +
+		"NOTE a comment\n" +
+		"\n" +
+		"00:01.000 --> 00:02.000 align:start line:0\n" +
+		"Short timestamps\n"
+
+	got, err := parseCaptions([]byte(vtt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("parseCaptions =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestParseCaptionsRejects(t *testing.T) {
+	tests := map[string]string{
+		"empty":          "",
+		"header only":    "WEBVTT\n",
+		"not captions":   "just some text\nmore text\n",
+		"bad timestamp":  "1\n00:00:01 --> 00:00:02,000\nHi\n",
+		"sixty seconds":  "1\n00:00:60,000 --> 00:01:02,000\nHi\n",
+		"no end":         "1\n00:00:01,000 -->\nHi\n",
+		"ends too early": "1\n00:00:02,000 --> 00:00:01,000\nHi\n",
+		"out of order":   "1\n00:00:05,000 --> 00:00:06,000\nA\n\n2\n00:00:01,000 --> 00:00:02,000\nB\n",
+		"timing in text": "1\n00:00:01,000 --> 00:00:02,000\n00:00:03,000 --> 00:00:04,000\n",
+		"id without cue": "WEBVTT\n\nintro\n",
+		"vtt ends early": "WEBVTT\n\n00:00:01,000 --> 00:00:00,500\nHi\n",
+		"zero length":    "WEBVTT\n\n00:00:01.000 --> 00:00:01.000\nHi\n",
+	}
+	for name, input := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := parseCaptions([]byte(input))
+			if !errors.Is(err, errInvalidCaptions) {
+				t.Errorf("err = %v, want errInvalidCaptions", err)
+			}
+		})
+	}
+}
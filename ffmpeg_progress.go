@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// runFFmpeg runs ffmpeg with args and reports how far it has got through
+// an input of duration seconds, as a percentage, to progress. It reads
+// ffmpeg's -progress output; progress may be nil, and with an unknown
+// duration nothing is reported. Errors carry the end of ffmpeg's stderr.
+func runFFmpeg(ctx context.Context, args []string, duration float64, progress func(percent float64)) error {
+	args = append([]string{"-nostats", "-progress", "pipe:1"}, args...)
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		if progress == nil || duration <= 0 {
+			continue
+		}
+		key, value, _ := strings.Cut(scanner.Text(), "=")
+		switch key {
+		case "out_time_us":
+			outTime, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || outTime < 0 {
+				continue
+			}
+			progress(min(100, float64(outTime)/1e6/duration*100))
+		case "progress":
+			if value == "end" {
+				progress(100)
+			}
+		}
+	}
+	// Don't leave ffmpeg blocked on a full pipe if scanning gave up early.
+	io.Copy(io.Discard, stdout)
+
+	err = cmd.Wait()
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, lastLines(stderr.String(), 5))
+	}
+	return nil
+}
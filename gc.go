@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+)
+
+const (
+	gcModeDelete     = "delete"
+	gcModeQuarantine = "quarantine"
+
+	// quarantinePrefix holds orphans set aside by the garbage collector. It's
+	// never collected itself; empty it by hand once nobody has complained.
+	quarantinePrefix = "quarantine/"
+)
+
+type gcOptions struct {
+	gracePeriod time.Duration
+	mode        string
+	dryRun      bool
+}
+
+type gcOrphan struct {
+	key  string
+	size int64
+	// assetPath is set for files found in assetsRoot outside the storage
+	// backend, key is then relative to assetsRoot.
+	assetPath string
+}
+
+type gcReport struct {
+	orphans []gcOrphan
+	bytes   int64
+}
+
+// collectGarbage finds stored objects and asset files no video points at
+// and that are older than the grace period, and deletes or quarantines them.
+// In dry-run mode it only reports what it would do.
+func (cfg *apiConfig) collectGarbage(ctx context.Context, opts gcOptions) (gcReport, error) {
+	cutoff := time.Now().Add(-opts.gracePeriod)
+
+	// List before loading references: anything stored after this point
+	// isn't a candidate, so a video attached in between can't be lost.
+	objects, err := cfg.storage.List(ctx, "")
+	if err != nil {
+		return gcReport{}, fmt.Errorf("couldn't list storage: %w", err)
+	}
+	assets, err := cfg.listStrayAssets()
+	if err != nil {
+		return gcReport{}, fmt.Errorf("couldn't list assets: %w", err)
+	}
+
+	referenced, err := cfg.referencedMedia()
+	if err != nil {
+		return gcReport{}, err
+	}
+
+	report := gcReport{}
+	for _, object := range objects {
+		if strings.HasPrefix(object.Key, quarantinePrefix) || referenced.contains(object.Key) || object.LastModified.After(cutoff) {
+			continue
+		}
+		report.orphans = append(report.orphans, gcOrphan{key: object.Key, size: object.Size})
+	}
+	for _, asset := range assets {
+		if referenced.contains(asset.key) || asset.modified.After(cutoff) {
+			continue
+		}
+		report.orphans = append(report.orphans, gcOrphan{key: asset.key, size: asset.size, assetPath: asset.path})
+	}
+	for _, orphan := range report.orphans {
+		report.bytes += orphan.size
+	}
+	if opts.dryRun {
+		return report, nil
+	}
+
+	for _, orphan := range report.orphans {
+		err := cfg.removeOrphan(ctx, orphan, opts.mode)
+		if err != nil {
+			return report, fmt.Errorf("couldn't %s %s: %w", opts.mode, orphan.key, err)
+		}
+	}
+	return report, nil
+}
+
+type mediaReferences struct {
+	keys map[string]bool
+	// prefixes hold files derived from a processed video, see
+	// videoMediaPrefix.
+	prefixes map[string]bool
+}
+
+func (m mediaReferences) contains(key string) bool {
+	if m.keys[key] {
+		return true
+	}
+	for dir := path.Dir(key); dir != "." && dir != "/"; dir = path.Dir(dir) {
+		if m.prefixes[dir+"/"] {
+			return true
+		}
+	}
+	return false
+}
+
+func (cfg *apiConfig) referencedMedia() (mediaReferences, error) {
+	videos, err := cfg.db.GetAllVideos()
+	if err != nil {
+		return mediaReferences{}, fmt.Errorf("couldn't load videos: %w", err)
+	}
+	watermarks, err := cfg.db.GetAllWatermarks()
+	if err != nil {
+		return mediaReferences{}, fmt.Errorf("couldn't load watermarks: %w", err)
+	}
+
+	references := mediaReferences{keys: map[string]bool{}, prefixes: map[string]bool{}}
+	for _, video := range videos {
+		references.prefixes[captionsPrefix(video.ID)] = true
+		for _, stored := range []*string{video.ThumbnailURL, video.VideoURL, video.HLSURL, video.OriginalKey} {
+			if stored == nil {
+				continue
+			}
+			key, ok := cfg.objectKey(*stored)
+			if !ok {
+				// We can't tell what this points at, so we can't tell what's
+				// safe to remove either.
+				return mediaReferences{}, fmt.Errorf("video %s references %q, which isn't a storage key", video.ID, *stored)
+			}
+			references.keys[key] = true
+			if stored == video.VideoURL {
+				references.prefixes[videoMediaPrefix(key)] = true
+			}
+			if stored == video.ThumbnailURL {
+				if prefix, ok := thumbnailMediaPrefix(key); ok {
+					references.prefixes[prefix] = true
+				}
+			}
+		}
+	}
+	for _, watermark := range watermarks {
+		references.keys[watermark.ImageURL] = true
+	}
+	return references, nil
+}
+
+type strayAsset struct {
+	key      string
+	path     string
+	size     int64
+	modified time.Time
+}
+
+// listStrayAssets lists files in assetsRoot when it isn't the storage
+// backend itself; thumbnails used to be written there whatever the backend
+// was.
+func (cfg *apiConfig) listStrayAssets() ([]strayAsset, error) {
+	if cfg.storageBackend == "local" {
+		return nil, nil
+	}
+	assets := []strayAsset{}
+	err := filepath.WalkDir(cfg.assetsRoot, func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(cfg.assetsRoot, filePath)
+		if err != nil {
+			return err
+		}
+		assets = append(assets, strayAsset{
+			key:      filepath.ToSlash(rel),
+			path:     filePath,
+			size:     info.Size(),
+			modified: info.ModTime(),
+		})
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return assets, err
+}
+
+func (cfg *apiConfig) removeOrphan(ctx context.Context, orphan gcOrphan, mode string) error {
+	if orphan.assetPath != "" {
+		if mode == gcModeQuarantine {
+			err := cfg.putFile(ctx, orphan.assetPath, quarantinePrefix+"assets/"+orphan.key, contentTypeForFile(orphan.key))
+			if err != nil {
+				return err
+			}
+		}
+		return os.Remove(orphan.assetPath)
+	}
+
+	// quarantine/ is in the public bucket, so objects kept out of it
+	// (abandoned direct uploads and originals) are deleted outright.
+	private := strings.HasPrefix(orphan.key, incomingKeyPrefix) || strings.HasPrefix(orphan.key, originalKeyPrefix)
+	if mode == gcModeQuarantine && !private {
+		err := cfg.copyObject(ctx, orphan.key, quarantinePrefix+orphan.key)
+		if err != nil {
+			return err
+		}
+	}
+	return cfg.storage.Delete(ctx, orphan.key)
+}
+
+func (cfg *apiConfig) copyObject(ctx context.Context, from, to string) error {
+	info, err := cfg.storage.Stat(ctx, from)
+	if err != nil {
+		return err
+	}
+	body, err := cfg.storage.Get(ctx, from)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	return cfg.storage.Put(ctx, to, body, storage.PutOptions{ContentType: info.ContentType})
+}
+
+// startGarbageCollection runs the collector every interval for as long as
+// the server is up.
+func (cfg *apiConfig) startGarbageCollection(ctx context.Context, interval time.Duration, opts gcOptions) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			report, err := cfg.collectGarbage(ctx, opts)
+			if err != nil {
+				log.Printf("Garbage collection failed: %v", err)
+				continue
+			}
+			if len(report.orphans) > 0 {
+				log.Printf("Garbage collection: %s %d orphaned files, %d bytes", gcModePastTense(opts.mode), len(report.orphans), report.bytes)
+			}
+		}
+	}()
+}
+
+func gcModePastTense(mode string) string {
+	if mode == gcModeQuarantine {
+		return "quarantined"
+	}
+	return "deleted"
+}
+
+// runGCCommand implements "tubely gc", a one-off run of the collector.
+func (cfg *apiConfig) runGCCommand(args []string, defaults gcOptions, out io.Writer) error {
+	flags := flag.NewFlagSet("gc", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "only report what would be removed")
+	gracePeriod := flags.Duration("grace", defaults.gracePeriod, "leave files younger than this alone")
+	mode := flags.String("mode", defaults.mode, "what to do with orphans: delete or quarantine")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if *mode != gcModeDelete && *mode != gcModeQuarantine {
+		return fmt.Errorf("unknown mode %q (expected delete or quarantine)", *mode)
+	}
+
+	opts := gcOptions{gracePeriod: *gracePeriod, mode: *mode, dryRun: *dryRun}
+	report, err := cfg.collectGarbage(context.Background(), opts)
+	for _, orphan := range report.orphans {
+		source := "storage"
+		if orphan.assetPath != "" {
+			source = "assets"
+		}
+		fmt.Fprintf(out, "%s\t%s\t%d\n", source, orphan.key, orphan.size)
+	}
+	if err != nil {
+		return err
+	}
+
+	if opts.dryRun {
+		fmt.Fprintf(out, "%d orphaned files would be %s, reclaiming %d bytes\n", len(report.orphans), gcModePastTense(opts.mode), report.bytes)
+	} else {
+		fmt.Fprintf(out, "%d orphaned files %s, reclaimed %d bytes\n", len(report.orphans), gcModePastTense(opts.mode), report.bytes)
+	}
+	return nil
+}
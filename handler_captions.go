@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+func (cfg *apiConfig) handlerCaptionsList(w http.ResponseWriter, r *http.Request) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid video ID", err)
+		return
+	}
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	// Don't let on that a private video exists.
+	if video.ID == uuid.Nil || !cfg.canView(r, video) {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+
+	captions := cfg.presentVideo(r.Context(), video).Captions
+	if captions == nil {
+		captions = []database.Caption{}
+	}
+	respondWithJSON(w, http.StatusOK, captions)
+}
+
+// handlerCaptionCreate adds a caption track from a multipart form: the
+// WebVTT or SRT file as "captions", its "language" and an optional "label".
+func (cfg *apiConfig) handlerCaptionCreate(w http.ResponseWriter, r *http.Request) {
+	video, ok := cfg.authorizeVideoOwner(w, r)
+	if !ok {
+		return
+	}
+	form, err := readCaptionForm(w, r, true)
+	if err != nil {
+		respondWithCaptionError(w, err)
+		return
+	}
+
+	key, err := cfg.putCaptionFile(r.Context(), video.ID, form.vtt)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save captions", err)
+		return
+	}
+	if form.label == "" {
+		form.label = form.language
+	}
+	caption, err := cfg.db.CreateCaption(database.CreateCaptionParams{
+		VideoID:  video.ID,
+		Language: form.language,
+		Label:    form.label,
+		URL:      key,
+	})
+	if err != nil {
+		cfg.releaseMedia(captionMediaRelease(key))
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create caption", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, cfg.presentCaption(r.Context(), video, caption))
+}
+
+// handlerCaptionReplace replaces a caption track's file, with the same form
+// as handlerCaptionCreate. A language or label that's left out is kept.
+func (cfg *apiConfig) handlerCaptionReplace(w http.ResponseWriter, r *http.Request) {
+	video, caption, ok := cfg.authorizeCaption(w, r)
+	if !ok {
+		return
+	}
+	form, err := readCaptionForm(w, r, false)
+	if err != nil {
+		respondWithCaptionError(w, err)
+		return
+	}
+
+	key, err := cfg.putCaptionFile(r.Context(), video.ID, form.vtt)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save captions", err)
+		return
+	}
+	released := captionMediaRelease(caption.URL)
+	caption.URL = key
+	if form.language != "" {
+		caption.Language = form.language
+	}
+	if form.label != "" {
+		caption.Label = form.label
+	}
+	err = cfg.db.UpdateCaptionReplacingMedia(caption, released)
+	if err != nil {
+		cfg.releaseMedia(captionMediaRelease(key))
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update caption", err)
+		return
+	}
+	cfg.storageCleanup.notify()
+
+	respondWithJSON(w, http.StatusOK, cfg.presentCaption(r.Context(), video, caption))
+}
+
+func (cfg *apiConfig) handlerCaptionDelete(w http.ResponseWriter, r *http.Request) {
+	video, caption, ok := cfg.authorizeCaption(w, r)
+	if !ok {
+		return
+	}
+
+	err := cfg.db.DeleteCaptionAndMedia(caption.ID, captionMediaRelease(caption.URL, captionPlaylistKey(caption)))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't delete caption", err)
+		return
+	}
+	cfg.storageCleanup.notify()
+	cfg.updateCaptionsHLS(r.Context(), video)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// authorizeCaption is authorizeVideoOwner for the caption named in the path,
+// which has to belong to the video.
+func (cfg *apiConfig) authorizeCaption(w http.ResponseWriter, r *http.Request) (database.Video, database.Caption, bool) {
+	video, ok := cfg.authorizeVideoOwner(w, r)
+	if !ok {
+		return database.Video{}, database.Caption{}, false
+	}
+	captionID, err := uuid.Parse(r.PathValue("captionID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid caption ID", err)
+		return database.Video{}, database.Caption{}, false
+	}
+	caption, err := cfg.db.GetCaption(captionID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get caption", err)
+		return database.Video{}, database.Caption{}, false
+	}
+	if caption.ID == uuid.Nil || caption.VideoID != video.ID {
+		respondWithError(w, http.StatusNotFound, "Caption not found", nil)
+		return database.Video{}, database.Caption{}, false
+	}
+	return video, caption, true
+}
+
+// presentCaption brings the video's HLS master up to date with a caption
+// that was just added or changed, and returns the caption the way the
+// video's responses show it.
+func (cfg *apiConfig) presentCaption(ctx context.Context, video database.Video, caption database.Caption) database.Caption {
+	video = cfg.updateCaptionsHLS(ctx, video)
+	for _, presented := range cfg.presentVideo(ctx, video).Captions {
+		if presented.ID == caption.ID {
+			return presented
+		}
+	}
+	caption.URL = ""
+	return caption
+}
+
+// updateCaptionsHLS is publishCaptionsHLS for handlers: the captions are
+// saved either way, so a failure is only logged.
+func (cfg *apiConfig) updateCaptionsHLS(ctx context.Context, video database.Video) database.Video {
+	updated, err := cfg.publishCaptionsHLS(ctx, video)
+	if err != nil {
+		log.Printf("Couldn't add captions to the HLS playlist of video %s: %v", video.ID, err)
+		return video
+	}
+	return updated
+}
+
+type captionForm struct {
+	language string
+	label    string
+	vtt      []byte
+}
+
+// readCaptionForm reads and validates a caption upload; the language is
+// only required when requireLanguage is set. Problems with what was sent
+// are reported as errInvalidCaptions.
+func readCaptionForm(w http.ResponseWriter, r *http.Request, requireLanguage bool) (captionForm, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, captionUploadLimit)
+	err := r.ParseMultipartForm(captionUploadLimit)
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			return captionForm{}, err
+		}
+		return captionForm{}, fmt.Errorf("%w: %v", errInvalidCaptions, err)
+	}
+
+	form := captionForm{
+		language: r.FormValue("language"),
+		label:    r.FormValue("label"),
+	}
+	if form.language == "" && requireLanguage {
+		return captionForm{}, fmt.Errorf("%w: language is required", errInvalidCaptions)
+	}
+	if form.language != "" && !captionLanguagePattern.MatchString(form.language) {
+		return captionForm{}, fmt.Errorf("%w: %q isn't a language tag such as en or pt-BR", errInvalidCaptions, form.language)
+	}
+
+	file, _, err := r.FormFile("captions")
+	if err != nil {
+		return captionForm{}, fmt.Errorf("%w: no captions file provided", errInvalidCaptions)
+	}
+	defer file.Close()
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return captionForm{}, err
+	}
+	form.vtt, err = parseCaptions(data)
+	if err != nil {
+		return captionForm{}, err
+	}
+	return form, nil
+}
+
+func respondWithCaptionError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errInvalidCaptions) {
+		respondWithError(w, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+	respondWithUploadError(w, "Couldn't read captions", err)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func (cfg *apiConfig) handlerThumbnailGenerate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		// Timestamp is in seconds from the start of the video. Without it
+		// the server's configured thumbnail mode is used.
+		Timestamp *float64 `json:"timestamp"`
+	}
+
+	video, ok := cfg.authorizeVideoOwner(w, r)
+	if !ok {
+		return
+	}
+
+	params := parameters{}
+	err := json.NewDecoder(r.Body).Decode(&params)
+	if err != nil && !errors.Is(err, io.EOF) {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	at, mode := cfg.thumbnailTimestamp, cfg.thumbnailMode
+	if params.Timestamp != nil {
+		if *params.Timestamp < 0 {
+			respondWithError(w, http.StatusBadRequest, "Timestamp can't be negative", nil)
+			return
+		}
+		if video.DurationSeconds != nil && *params.Timestamp >= *video.DurationSeconds {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Timestamp must be before the end of the video (%.3fs)", *video.DurationSeconds), nil)
+			return
+		}
+		at = time.Duration(*params.Timestamp * float64(time.Second))
+		mode = thumbnailModeTimestamp
+	}
+
+	if video.VideoURL == nil {
+		respondWithError(w, http.StatusConflict, "Video hasn't been processed yet", nil)
+		return
+	}
+	videoKey, ok := cfg.objectKey(*video.VideoURL)
+	if !ok {
+		respondWithError(w, http.StatusConflict, "Video isn't stored in the current storage backend", nil)
+		return
+	}
+
+	videoPath, err := cfg.downloadToTemp(r.Context(), videoKey, "thumbnail-source-*"+filepath.Ext(videoKey))
+	if err != nil {
+		respondWithUploadError(w, "Couldn't download video", err)
+		return
+	}
+	defer cfg.removeUpload(videoPath)
+
+	video, err = cfg.generateThumbnail(r.Context(), video, videoPath, at, mode)
+	if errors.Is(err, database.ErrVideoChanged) {
+		respondWithError(w, http.StatusConflict, "Thumbnail was changed by another request", err)
+		return
+	}
+	if err != nil {
+		respondWithUploadError(w, "Couldn't generate thumbnail", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, cfg.presentVideo(r.Context(), video))
+}
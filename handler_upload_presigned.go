@@ -0,0 +1,222 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+)
+
+const presignedUploadTTL = 15 * time.Minute
+
+// incomingKeyPrefix is where browsers upload raw videos before we process
+// them. Like originals, these live in the private bucket.
+const incomingKeyPrefix = "incoming/"
+
+// incomingPrefix scopes every key to a single video, so a caller can only
+// complete uploads for videos they own.
+func incomingPrefix(videoID string) string {
+	return incomingKeyPrefix + videoID + "/"
+}
+
+func (cfg *apiConfig) handlerUploadVideoPresign(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		ContentType string `json:"content_type"`
+		// Size is the exact length of the file, which the URL is signed for.
+		Size int64 `json:"size"`
+	}
+	type response struct {
+		UploadURL string            `json:"upload_url"`
+		Method    string            `json:"method"`
+		Headers   map[string]string `json:"headers"`
+		Key       string            `json:"key"`
+		ExpiresAt time.Time         `json:"expires_at"`
+	}
+
+	video, ok := cfg.authorizeVideoOwner(w, r)
+	if !ok {
+		return
+	}
+
+	presigner, ok := cfg.storage.(storage.Presigner)
+	if !ok {
+		respondWithError(w, http.StatusNotImplemented, "Storage backend doesn't support direct uploads", nil)
+		return
+	}
+	if !cfg.originalsPrivate {
+		respondWithError(w, http.StatusNotImplemented, "Direct uploads need ORIGINALS_BUCKET to be set", nil)
+		return
+	}
+
+	checksum, err := uploadChecksum(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+
+	params := parameters{}
+	err = json.NewDecoder(r.Body).Decode(&params)
+	if err != nil && !errors.Is(err, io.EOF) {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	if params.Size <= 0 {
+		respondWithError(w, http.StatusBadRequest, "Size is required", nil)
+		return
+	}
+	if params.Size > videoUploadLimit {
+		respondWithError(w, http.StatusRequestEntityTooLarge, "Video is too large", nil)
+		return
+	}
+	// Browsers leave the type empty for extensions they don't know. Either
+	// way the object is sniffed again when the upload is completed.
+	mediaType := "application/octet-stream"
+	extension := ".upload"
+	if params.ContentType != "" {
+		mediaType, _, err = mime.ParseMediaType(params.ContentType)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Couldn't parse media type", err)
+			return
+		}
+		err = cfg.checkDeclaredMediaType(mediaType)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error(), err)
+			return
+		}
+		format, _ := videoFormatByMediaType(mediaType)
+		extension = "." + format.name
+	}
+
+	randomBytes := make([]byte, 16)
+	_, err = rand.Read(randomBytes)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error creating random filename", err)
+		return
+	}
+	key := incomingPrefix(video.ID.String()) + hex.EncodeToString(randomBytes) + extension
+
+	uploadURL, headers, err := presigner.PresignPut(r.Context(), key, mediaType, params.Size, checksum, presignedUploadTTL)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't presign upload", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, response{
+		UploadURL: uploadURL,
+		Method:    http.MethodPut,
+		Headers:   headers,
+		Key:       key,
+		ExpiresAt: time.Now().UTC().Add(presignedUploadTTL),
+	})
+}
+
+func (cfg *apiConfig) handlerUploadVideoComplete(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Key string `json:"key"`
+	}
+
+	video, ok := cfg.authorizeVideoOwner(w, r)
+	if !ok {
+		return
+	}
+
+	// S3 already checked the upload against the checksum it was presigned
+	// with; the client sends it again so we can check our copy too.
+	checksum, err := uploadChecksum(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+
+	params := parameters{}
+	err = json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	if !strings.HasPrefix(params.Key, incomingPrefix(video.ID.String())) {
+		respondWithError(w, http.StatusBadRequest, "Key doesn't belong to this video", nil)
+		return
+	}
+
+	info, err := cfg.storage.Stat(r.Context(), params.Key)
+	if errors.Is(err, storage.ErrNotFound) {
+		respondWithError(w, http.StatusNotFound, "Uploaded object not found", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check uploaded object", err)
+		return
+	}
+	if info.Size > videoUploadLimit {
+		cfg.storage.Delete(r.Context(), params.Key)
+		respondWithError(w, http.StatusRequestEntityTooLarge, "Video is too large", nil)
+		return
+	}
+
+	// ffprobe and ffmpeg need a local file, so pull the object down once and
+	// hand it to the processing queue.
+	tempFile, err := os.CreateTemp(cfg.uploadsRoot, "video-*.upload")
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create temp file", err)
+		return
+	}
+	defer tempFile.Close()
+
+	body, err := cfg.storage.Get(r.Context(), params.Key)
+	if err != nil {
+		cfg.removeUpload(tempFile.Name())
+		respondWithError(w, http.StatusInternalServerError, "Couldn't download uploaded object", err)
+		return
+	}
+	hashed, err := newHashingWriter(cfg.uploadLimits.writer(tempFile), checksum)
+	if err != nil {
+		body.Close()
+		cfg.removeUpload(tempFile.Name())
+		respondWithError(w, http.StatusInternalServerError, "Couldn't write to temp file", err)
+		return
+	}
+	_, err = io.Copy(hashed, io.LimitReader(body, videoUploadLimit))
+	body.Close()
+	if err != nil {
+		cfg.removeUpload(tempFile.Name())
+		respondWithUploadError(w, "Couldn't write to temp file", err)
+		return
+	}
+	err = hashed.verify()
+	if err != nil {
+		cfg.removeUpload(tempFile.Name())
+		cfg.storage.Delete(r.Context(), params.Key)
+		respondWithError(w, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+
+	video, err = cfg.enqueueProcessing(r.Context(), video, tempFile.Name(), hashed.sum(), nil, nil)
+	if errors.Is(err, errUnsupportedVideo) {
+		cfg.removeUpload(tempFile.Name())
+		cfg.storage.Delete(r.Context(), params.Key)
+		respondWithError(w, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+	if err != nil {
+		cfg.removeUpload(tempFile.Name())
+		respondWithError(w, http.StatusInternalServerError, "Couldn't queue video for processing", err)
+		return
+	}
+
+	err = cfg.storage.Delete(r.Context(), params.Key)
+	if err != nil {
+		log.Printf("Couldn't delete incoming object %s: %v", params.Key, err)
+	}
+
+	respondWithJSON(w, http.StatusAccepted, cfg.presentVideo(r.Context(), video))
+}
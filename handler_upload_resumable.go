@@ -0,0 +1,452 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// Resumable uploads follow the core of the tus protocol (https://tus.io):
+// create a session with the total length, PATCH chunks at the current
+// offset and HEAD to find out where to resume after a dropped connection.
+const (
+	tusResumable         = "1.0.0"
+	tusChunkContentType  = "application/offset+octet-stream"
+	headerUploadOffset   = "Upload-Offset"
+	headerUploadLength   = "Upload-Length"
+	headerUploadMetadata = "Upload-Metadata"
+	headerUploadExpires  = "Upload-Expires"
+)
+
+// uploadSessionSweepInterval is how often sessions that expired are removed
+// along with their partial files.
+const uploadSessionSweepInterval = time.Hour
+
+// uploadLocks makes sure only one request writes to a session file at a time.
+type uploadLocks struct {
+	mu     sync.Mutex
+	active map[uuid.UUID]bool
+}
+
+func newUploadLocks() *uploadLocks {
+	return &uploadLocks{active: map[uuid.UUID]bool{}}
+}
+
+func (l *uploadLocks) tryLock(id uuid.UUID) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.active[id] {
+		return false
+	}
+	l.active[id] = true
+	return true
+}
+
+func (l *uploadLocks) unlock(id uuid.UUID) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.active, id)
+}
+
+func (cfg *apiConfig) handlerUploadSessionCreate(w http.ResponseWriter, r *http.Request) {
+	video, ok := cfg.authorizeVideoOwner(w, r)
+	if !ok {
+		return
+	}
+
+	length, err := strconv.ParseInt(r.Header.Get(headerUploadLength), 10, 64)
+	if err != nil || length <= 0 {
+		respondWithError(w, http.StatusBadRequest, "Upload-Length header must be a positive integer", err)
+		return
+	}
+	if length > videoUploadLimit {
+		respondWithError(w, http.StatusRequestEntityTooLarge, "Video is too large", nil)
+		return
+	}
+
+	// The declared type only lets us turn away the wrong kind of file early,
+	// the upload is sniffed again once it's complete.
+	mediaType := "application/octet-stream"
+	if fileType := parseUploadMetadata(r.Header.Get(headerUploadMetadata))["filetype"]; fileType != "" {
+		mediaType, _, err = mime.ParseMediaType(fileType)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Couldn't parse media type", err)
+			return
+		}
+		err = cfg.checkDeclaredMediaType(mediaType)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error(), err)
+			return
+		}
+	}
+
+	file, err := os.CreateTemp(cfg.uploadsRoot, "session-*.part")
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create upload file", err)
+		return
+	}
+	file.Close()
+
+	session, err := cfg.db.CreateUploadSession(database.CreateUploadSessionParams{
+		VideoID:   video.ID,
+		UserID:    video.UserID,
+		Length:    length,
+		MediaType: mediaType,
+	}, file.Name())
+	if err != nil {
+		cfg.removeUpload(file.Name())
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create upload session", err)
+		return
+	}
+
+	w.Header().Set("Tus-Resumable", tusResumable)
+	w.Header().Set("Location", "/api/upload_sessions/"+session.ID.String())
+	w.Header().Set(headerUploadOffset, "0")
+	cfg.setUploadExpires(w, session.UpdatedAt)
+	respondWithJSON(w, http.StatusCreated, session)
+}
+
+func (cfg *apiConfig) handlerUploadSessionHead(w http.ResponseWriter, r *http.Request) {
+	session, ok := cfg.authorizeUploadSession(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Tus-Resumable", tusResumable)
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set(headerUploadOffset, strconv.FormatInt(session.Offset, 10))
+	w.Header().Set(headerUploadLength, strconv.FormatInt(session.Length, 10))
+	if session.CompletedAt == nil {
+		cfg.setUploadExpires(w, session.UpdatedAt)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (cfg *apiConfig) handlerUploadSessionPatch(w http.ResponseWriter, r *http.Request) {
+	session, ok := cfg.authorizeUploadSession(w, r)
+	if !ok {
+		return
+	}
+	if session.CompletedAt != nil {
+		respondWithError(w, http.StatusConflict, "Upload is already complete", nil)
+		return
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != tusChunkContentType {
+		respondWithError(w, http.StatusUnsupportedMediaType, "Content-Type must be "+tusChunkContentType, nil)
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.Header.Get(headerUploadOffset), 10, 64)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Upload-Offset header must be an integer", err)
+		return
+	}
+
+	if !cfg.uploadLocks.tryLock(session.ID) {
+		respondWithError(w, http.StatusLocked, "Another request is writing to this upload", nil)
+		return
+	}
+	defer cfg.uploadLocks.unlock(session.ID)
+
+	// Re-read under the lock, a concurrent PATCH may have moved the offset
+	// or the sweep removed the session.
+	session, err = cfg.db.GetUploadSession(session.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get upload session", err)
+		return
+	}
+	if session.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Upload session not found", nil)
+		return
+	}
+	if offset != session.Offset {
+		w.Header().Set(headerUploadOffset, strconv.FormatInt(session.Offset, 10))
+		respondWithError(w, http.StatusConflict, "Upload-Offset doesn't match the current offset", nil)
+		return
+	}
+
+	written, copyErr := cfg.writeUploadChunk(session, r.Body)
+	if written > 0 {
+		session.Offset += written
+		err = cfg.db.UpdateUploadSessionOffset(session.ID, session.Offset)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't save upload offset", err)
+			return
+		}
+	}
+	w.Header().Set("Tus-Resumable", tusResumable)
+	w.Header().Set(headerUploadOffset, strconv.FormatInt(session.Offset, 10))
+	if written > 0 {
+		cfg.setUploadExpires(w, time.Now())
+	} else {
+		cfg.setUploadExpires(w, session.UpdatedAt)
+	}
+	if copyErr != nil {
+		if errors.Is(copyErr, errChunkTooLarge) {
+			respondWithError(w, http.StatusRequestEntityTooLarge, "Chunk exceeds Upload-Length", copyErr)
+			return
+		}
+		if errors.Is(copyErr, errUploadDiskFull) {
+			respondWithUploadError(w, "Couldn't write chunk", copyErr)
+			return
+		}
+		respondWithError(w, http.StatusBadRequest, "Couldn't read chunk", copyErr)
+		return
+	}
+
+	if session.Offset < session.Length {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	video, err := cfg.finishUploadSession(r.Context(), session)
+	if errors.Is(err, errUnsupportedVideo) {
+		respondWithError(w, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+	if errors.Is(err, database.ErrUploadSessionClosed) {
+		respondWithError(w, http.StatusNotFound, "Upload session not found", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't queue video for processing", err)
+		return
+	}
+	respondWithJSON(w, http.StatusAccepted, cfg.presentVideo(r.Context(), video))
+}
+
+func (cfg *apiConfig) handlerUploadSessionDelete(w http.ResponseWriter, r *http.Request) {
+	session, ok := cfg.authorizeUploadSession(w, r)
+	if !ok {
+		return
+	}
+	// The file belongs to the processing queue now.
+	if session.CompletedAt != nil {
+		respondWithError(w, http.StatusConflict, "Upload is already complete", nil)
+		return
+	}
+	if !cfg.uploadLocks.tryLock(session.ID) {
+		respondWithError(w, http.StatusLocked, "Another request is writing to this upload", nil)
+		return
+	}
+	defer cfg.uploadLocks.unlock(session.ID)
+
+	err := cfg.db.DeleteUploadSession(session.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't delete upload session", err)
+		return
+	}
+	cfg.removeUpload(session.FilePath)
+
+	w.Header().Set("Tus-Resumable", tusResumable)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (cfg *apiConfig) authorizeUploadSession(w http.ResponseWriter, r *http.Request) (database.UploadSession, bool) {
+	sessionID, err := uuid.Parse(r.PathValue("uploadID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return database.UploadSession{}, false
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return database.UploadSession{}, false
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return database.UploadSession{}, false
+	}
+
+	session, err := cfg.db.GetUploadSession(sessionID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get upload session", err)
+		return database.UploadSession{}, false
+	}
+	if session.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Upload session not found", nil)
+		return database.UploadSession{}, false
+	}
+	if session.UserID != userID {
+		respondWithError(w, http.StatusForbidden, "You don't have permission to modify this upload", nil)
+		return database.UploadSession{}, false
+	}
+	if session.CompletedAt == nil && cfg.uploadSessionExpired(session.UpdatedAt) {
+		respondWithError(w, http.StatusGone, "Upload session expired", nil)
+		return database.UploadSession{}, false
+	}
+	return session, true
+}
+
+// uploadSessionExpired reports whether an unfinished session last written
+// to at lastActivity has expired. A zero cfg.uploadSessionTTL never expires
+// sessions.
+func (cfg *apiConfig) uploadSessionExpired(lastActivity time.Time) bool {
+	return cfg.uploadSessionTTL > 0 && time.Since(lastActivity) > cfg.uploadSessionTTL
+}
+
+// setUploadExpires tells the client until when it can resume the upload.
+func (cfg *apiConfig) setUploadExpires(w http.ResponseWriter, lastActivity time.Time) {
+	if cfg.uploadSessionTTL > 0 {
+		w.Header().Set(headerUploadExpires, lastActivity.Add(cfg.uploadSessionTTL).UTC().Format(http.TimeFormat))
+	}
+}
+
+// startUploadSessionSweep removes expired sessions every
+// uploadSessionSweepInterval, starting straight away, so abandoned partial
+// files don't hold on to the uploads disk budget.
+func (cfg *apiConfig) startUploadSessionSweep(ctx context.Context) {
+	if cfg.uploadSessionTTL <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(uploadSessionSweepInterval)
+		defer ticker.Stop()
+		for {
+			removed, err := cfg.sweepUploadSessions()
+			if err != nil {
+				log.Printf("Couldn't sweep upload sessions: %v", err)
+			} else if removed > 0 {
+				log.Printf("Removed %d expired upload sessions", removed)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// sweepUploadSessions deletes the sessions that expired. A completed
+// session's file belongs to the processing queue, so only its row goes.
+func (cfg *apiConfig) sweepUploadSessions() (int, error) {
+	sessions, err := cfg.db.GetStaleUploadSessions(time.Now().Add(-cfg.uploadSessionTTL))
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, stale := range sessions {
+		if !cfg.uploadLocks.tryLock(stale.ID) {
+			continue
+		}
+		// A PATCH may have come in since the list was read.
+		session, err := cfg.db.GetUploadSession(stale.ID)
+		if err == nil && session.ID != uuid.Nil && cfg.uploadSessionExpired(session.UpdatedAt) {
+			err = cfg.db.DeleteUploadSession(session.ID)
+			if err == nil {
+				if session.CompletedAt == nil {
+					cfg.removeUpload(session.FilePath)
+				}
+				removed++
+			}
+		}
+		cfg.uploadLocks.unlock(stale.ID)
+		if err != nil {
+			return removed, err
+		}
+	}
+	return removed, nil
+}
+
+var errChunkTooLarge = errors.New("chunk exceeds upload length")
+
+// writeUploadChunk appends body to the session file at the stored offset and
+// reports how many bytes made it to disk, even when the body is cut short.
+func (cfg *apiConfig) writeUploadChunk(session database.UploadSession, body io.Reader) (int64, error) {
+	file, err := os.OpenFile(session.FilePath, os.O_WRONLY, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	// Drop any bytes past the recorded offset left over from a write that
+	// failed before the offset could be saved.
+	err = file.Truncate(session.Offset)
+	if err != nil {
+		return 0, err
+	}
+	if info.Size() > session.Offset {
+		cfg.uploadLimits.free(info.Size() - session.Offset)
+	}
+	_, err = file.Seek(session.Offset, io.SeekStart)
+	if err != nil {
+		return 0, err
+	}
+
+	remaining := session.Length - session.Offset
+	written, err := io.Copy(cfg.uploadLimits.writer(file), io.LimitReader(body, remaining))
+	if err != nil {
+		return written, err
+	}
+
+	var extra [1]byte
+	if n, _ := body.Read(extra[:]); n > 0 {
+		return written, errChunkTooLarge
+	}
+	return written, nil
+}
+
+// finishUploadSession hands the assembled file to the processing queue, which
+// takes over ownership of it. A file that turns out not to be a usable video
+// is thrown away together with its session.
+func (cfg *apiConfig) finishUploadSession(ctx context.Context, session database.UploadSession) (database.Video, error) {
+	video, err := cfg.db.GetVideo(session.VideoID)
+	if err != nil {
+		return database.Video{}, err
+	}
+	if video.ID == uuid.Nil {
+		return database.Video{}, fmt.Errorf("video %s no longer exists", session.VideoID)
+	}
+
+	video, err = cfg.enqueueProcessing(ctx, video, session.FilePath, "", nil, &session.ID)
+	if errors.Is(err, errUnsupportedVideo) {
+		cfg.removeUpload(session.FilePath)
+		cfg.db.DeleteUploadSession(session.ID)
+		return database.Video{}, err
+	}
+	if err != nil {
+		return database.Video{}, err
+	}
+	return video, nil
+}
+
+// parseUploadMetadata decodes the tus Upload-Metadata header, a comma
+// separated list of "key base64(value)" pairs.
+func parseUploadMetadata(header string) map[string]string {
+	metadata := map[string]string{}
+	for _, pair := range strings.Split(header, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			continue
+		}
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			continue
+		}
+		metadata[key] = string(value)
+	}
+	return metadata
+}
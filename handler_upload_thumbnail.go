@@ -1,19 +1,25 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
-	"path/filepath"
-	"strings"
 
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
 	"github.com/google/uuid"
 )
 
+const thumbnailUploadLimit = 10 << 20 // 10 MB
+
 func (cfg *apiConfig) handlerUploadThumbnail(w http.ResponseWriter, r *http.Request) {
 	videoIDString := r.PathValue("videoID")
 	videoID, err := uuid.Parse(videoIDString)
@@ -34,7 +40,7 @@ func (cfg *apiConfig) handlerUploadThumbnail(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	// ⭐ 1. NAJPIERW sprawdź uprawnienia (przed zapisywaniem pliku!)
+	// Check ownership before reading the upload.
 	videoMetadata, err := cfg.db.GetVideo(videoID)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve video", err)
@@ -49,73 +55,152 @@ func (cfg *apiConfig) handlerUploadThumbnail(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	// ⭐ 2. Teraz parsuj formularz
-	const maxMemory = 10 << 20            // 10 MB
-	err = r.ParseMultipartForm(maxMemory) // ⭐ Sprawdź błąd!
+	checksum, err := uploadChecksum(r.Header)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Unable to parse form data", err)
+		respondWithError(w, http.StatusBadRequest, err.Error(), err)
 		return
 	}
 
-	fileData, fileHeaders, err := r.FormFile("thumbnail")
+	// Stream the file part rather than buffering the whole form.
+	r.Body = http.MaxBytesReader(w, r.Body, thumbnailUploadLimit)
+	fileData, err := formFilePart(r, "thumbnail")
 	if err != nil {
 		respondWithError(w, http.StatusBadRequest, "No thumbnail file provided", err)
 		return
 	}
 	defer fileData.Close()
 
-	// ⭐ 3. Walidacja Content-Type
-	contentType := fileHeaders.Header.Get("Content-Type")
-	parts := strings.Split(contentType, "/")
-
-	if len(parts) != 2 {
-		respondWithError(w, http.StatusBadRequest, "Invalid content type", nil)
+	// The part's Content-Type is only the browser's guess, storeThumbnail
+	// decodes the image to find out.
+	videoMetadata, err = cfg.storeThumbnail(r.Context(), videoMetadata, fileData, checksum)
+	if errors.Is(err, storage.ErrChecksumMismatch) || errors.Is(err, errInvalidImage) {
+		respondWithError(w, http.StatusBadRequest, err.Error(), err)
 		return
 	}
-
-	mediaType := parts[0]
-	mediaExtension := parts[1]
-
-	if mediaType != "image" || (mediaExtension != "jpeg" && mediaExtension != "png") {
-		respondWithError(w, http.StatusBadRequest, "Thumbnail must be a JPEG or PNG image", nil)
+	if errors.Is(err, database.ErrVideoChanged) {
+		respondWithError(w, http.StatusConflict, "Thumbnail was changed by another request", err)
 		return
 	}
-
-	// ⭐ 4. Generuj losową nazwę
-	randomBytes := make([]byte, 32)
-	_, err = rand.Read(randomBytes)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error creating random filename", err)
+		respondWithUploadError(w, "Error saving thumbnail", err)
 		return
 	}
-	randomFilename := base64.RawURLEncoding.EncodeToString(randomBytes)
 
-	filename := fmt.Sprintf("%s.%s", randomFilename, mediaExtension)
-	filePath := filepath.Join(cfg.assetsRoot, filename)
+	respondWithJSON(w, http.StatusOK, cfg.presentVideo(r.Context(), videoMetadata))
+}
 
-	// ⭐ 5. Zapisz plik
-	file, err := os.Create(filePath)
+// storeThumbnail processes an image (see processThumbnail), stores its
+// variants and points the video at them. Images are deduplicated by the
+// uploaded content: one that's already stored is shared rather than
+// processed and stored again. Uploaded and generated thumbnails both go
+// through here; checksum is the client's, if any, and a mismatch is
+// reported as storage.ErrChecksumMismatch. Anything that isn't a usable
+// image is reported as errInvalidImage.
+func (cfg *apiConfig) storeThumbnail(ctx context.Context, video database.Video, body io.Reader, checksum storage.Checksum) (database.Video, error) {
+	tempFile, err := os.CreateTemp(cfg.uploadsRoot, "thumbnail-*.upload")
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error creating a file", err)
-		return
+		return video, err
 	}
-	defer file.Close() // ⭐ WAŻNE!
+	defer cfg.removeUpload(tempFile.Name())
+	defer tempFile.Close()
 
-	_, err = io.Copy(file, fileData)
+	hashed, err := newHashingWriter(cfg.uploadLimits.writer(tempFile), checksum)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error saving a file", err)
-		return
+		return video, err
+	}
+	size, err := io.Copy(hashed, body)
+	if err != nil {
+		return video, fmt.Errorf("error saving a file: %w", err)
+	}
+	err = hashed.verify()
+	if err != nil {
+		return video, err
 	}
+	sum := hashed.sum()
 
-	// ⭐ 6. Zaktualizuj URL (używaj filename, nie videoID!)
-	dataUrl := fmt.Sprintf("http://localhost:%s/assets/%s", cfg.port, filename)
-	videoMetadata.ThumbnailURL = &dataUrl
+	blob, err := cfg.db.ReuseBlob(database.BlobKindThumbnail, sum)
+	if err != nil {
+		return video, err
+	}
+	if blob.Key == "" {
+		_, err = tempFile.Seek(0, io.SeekStart)
+		if err != nil {
+			return video, err
+		}
+		variants, err := processThumbnail(tempFile)
+		if err != nil {
+			return video, err
+		}
+		blob, err = cfg.putThumbnailBlob(ctx, variants, sum, size)
+		if err != nil {
+			return video, err
+		}
+	}
 
-	err = cfg.db.UpdateVideo(videoMetadata)
+	// The video holds a reference to blob from here on.
+	previous := video.ThumbnailURL
+	released := cfg.thumbnailMediaRelease(previous)
+	key := blob.Key
+	video.ThumbnailURL = &key
+	video.ThumbnailVariants = blob.Variants
+	video.ThumbnailChecksumSHA256 = blob.ChecksumSHA256
+
+	err = cfg.db.SetVideoThumbnail(video, previous, released)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Failed to update video metadata", err)
-		return // ⭐ WAŻNE!
+		cfg.releaseMedia(cfg.thumbnailMediaRelease(&key))
+		return video, fmt.Errorf("failed to update video thumbnail: %w", err)
 	}
+	cfg.storageCleanup.notify()
+	return video, nil
+}
 
-	respondWithJSON(w, http.StatusOK, videoMetadata)
+// putThumbnailBlob stores every variant under a new directory in
+// thumbnailKeyPrefix, one object per width, and registers them as the blob
+// of the upload that hashed to sum. The largest variant is the blob's key.
+func (cfg *apiConfig) putThumbnailBlob(ctx context.Context, variants []thumbnailVariant, sum string, size int64) (database.Blob, error) {
+	randomBytes := make([]byte, 32)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return database.Blob{}, fmt.Errorf("error creating random filename: %w", err)
+	}
+	// A new name for every image, so browsers never show a cached old one.
+	dir := thumbnailKeyPrefix + base64.RawURLEncoding.EncodeToString(randomBytes) + "/"
+
+	stored := make(database.ImageVariants, 0, len(variants))
+	var checksum storage.Checksum
+	for _, variant := range variants {
+		key := fmt.Sprintf("%s%d.%s", dir, variant.width, variant.extension)
+		h := sha256.Sum256(variant.data)
+		checksum = storage.Checksum{Algorithm: storage.ChecksumSHA256, Value: base64.StdEncoding.EncodeToString(h[:])}
+		err = cfg.storage.Put(ctx, key, bytes.NewReader(variant.data), storage.PutOptions{
+			ContentType: variant.contentType,
+			Checksum:    checksum,
+		})
+		if err != nil {
+			if len(stored) > 0 {
+				cfg.releaseMedia(cfg.thumbnailMediaRelease(&stored[0].URL))
+			}
+			return database.Blob{}, fmt.Errorf("error saving a file: %w", err)
+		}
+		stored = append(stored, database.ImageVariant{Width: variant.width, Height: variant.height, URL: key})
+	}
+	key := stored[len(stored)-1].URL
+
+	blob, err := cfg.db.AcquireBlob(database.CreateBlobParams{
+		Kind:           database.BlobKindThumbnail,
+		SHA256:         sum,
+		Key:            key,
+		Size:           size,
+		ChecksumSHA256: &checksum.Value,
+		Variants:       stored,
+	})
+	if err != nil {
+		cfg.releaseMedia(cfg.thumbnailMediaRelease(&key))
+		return database.Blob{}, err
+	}
+	// Someone stored the same image while we were processing ours.
+	if blob.Key != key {
+		cfg.releaseMedia(cfg.thumbnailMediaRelease(&key))
+	}
+	return blob, nil
 }
@@ -1,26 +1,18 @@
 package main
 
 import (
-	"bytes"
-	"crypto/rand"
-	"encoding/hex"
-	"encoding/json"
-	"fmt"
+	"errors"
 	"io"
-	"math"
-	"mime"
 	"net/http"
 	"os"
-	"os/exec"
-	"strings"
 
-	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
 	"github.com/google/uuid"
 )
 
+const videoUploadLimit = 1 << 30 // 1 GB
+
 func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request) {
-	const uploadLimit = 1 << 30 // 1 GB
 	videoIDString := r.PathValue("videoID")
 	videoID, err := uuid.Parse(videoIDString)
 	if err != nil {
@@ -54,163 +46,62 @@ func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request)
 		respondWithError(w, http.StatusForbidden, "You don't have permission to modify this video", nil)
 		return
 	}
-	r.Body = http.MaxBytesReader(w, r.Body, uploadLimit)
-	err = r.ParseMultipartForm(uploadLimit)
+	checksum, err := uploadChecksum(r.Header)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Couldn't parse multipart form", err)
+		respondWithError(w, http.StatusBadRequest, err.Error(), err)
 		return
 	}
 
-	fileData, fileHeaders, err := r.FormFile("video")
+	// The video part is streamed straight to disk, nothing of it is held in
+	// memory. Its Content-Type is whatever the browser guessed from the file
+	// extension; enqueueProcessing sniffs the bytes instead.
+	r.Body = http.MaxBytesReader(w, r.Body, videoUploadLimit)
+	fileData, err := formFilePart(r, "video")
 	if err != nil {
 		respondWithError(w, http.StatusBadRequest, "No video file provided", err)
 		return
 	}
 	defer fileData.Close()
 
-	contentType := fileHeaders.Header.Get("Content-Type")
-	mediaType, _, err := mime.ParseMediaType(contentType)
-
-	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Couldn't parse media type", err)
-		return
-	}
-	if mediaType != "video/mp4" {
-		respondWithError(w, http.StatusBadRequest, "Unsupported media type", nil)
-		return
-	}
-	parts := strings.Split(mediaType, "/")
-	if len(parts) != 2 {
-		respondWithError(w, http.StatusBadRequest, "Invalid content type", nil)
-		return
-	}
-	mediaExtension := parts[1]
-
-	tempFile, err := os.CreateTemp("", "tubely-upload.mp4")
+	// The file outlives this request, the processing queue picks it up from
+	// uploadsRoot and removes it when it's done.
+	tempFile, err := os.CreateTemp(cfg.uploadsRoot, "video-*.upload")
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't create temp file", err)
 		return
 	}
-	defer os.Remove(tempFile.Name())
 	defer tempFile.Close()
 
-	_, err = io.Copy(tempFile, fileData)
+	hashed, err := newHashingWriter(cfg.uploadLimits.writer(tempFile), checksum)
 	if err != nil {
+		cfg.removeUpload(tempFile.Name())
 		respondWithError(w, http.StatusInternalServerError, "Couldn't write to temp file", err)
 		return
 	}
-	_, err = tempFile.Seek(0, io.SeekStart)
+	_, err = io.Copy(hashed, fileData)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't seek to beginning of temp file", err)
+		cfg.removeUpload(tempFile.Name())
+		respondWithUploadError(w, "Couldn't write to temp file", err)
 		return
 	}
-
-	videoAspectRatio, err := getVideoAspectRatio(tempFile.Name())
+	err = hashed.verify()
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't get video aspect ratio", err)
+		cfg.removeUpload(tempFile.Name())
+		respondWithError(w, http.StatusBadRequest, err.Error(), err)
 		return
 	}
 
-	fastVideoPath, err := processVideoForFastStart(tempFile.Name())
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't process video", err)
+	videoMetadata, err = cfg.enqueueProcessing(r.Context(), videoMetadata, tempFile.Name(), hashed.sum(), nil, nil)
+	if errors.Is(err, errUnsupportedVideo) {
+		cfg.removeUpload(tempFile.Name())
+		respondWithError(w, http.StatusBadRequest, err.Error(), err)
 		return
 	}
-	defer os.Remove(fastVideoPath)
-	fastVideofile, err := os.Open(fastVideoPath)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't open processed video", err)
+		cfg.removeUpload(tempFile.Name())
+		respondWithError(w, http.StatusInternalServerError, "Couldn't queue video for processing", err)
 		return
 	}
-	defer fastVideofile.Close()
-
-	randomBytes := make([]byte, 32)
-	_, err = rand.Read(randomBytes)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error creating random filename", err)
-		return
-	}
-	hexString := hex.EncodeToString(randomBytes)
-	filename := videoAspectRatio + "/" + hexString + "." + mediaExtension
-	object := &s3.PutObjectInput{
-		Bucket:      &cfg.s3Bucket,
-		Key:         &filename,
-		Body:        fastVideofile,
-		ContentType: &contentType,
-	}
-	_, err = cfg.s3Client.PutObject(r.Context(), object)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't upload to S3", err)
-		return
-	}
-
-	s3VideoUrl := fmt.Sprintf("https://%v/%v", cfg.s3CfDistribution, filename)
-	videoMetadata.VideoURL = &s3VideoUrl
-	err = cfg.db.UpdateVideo(videoMetadata)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
-		return
-	}
-
-	respondWithJSON(w, http.StatusOK, videoMetadata)
 
-}
-
-type videoParams struct {
-	Streams []struct {
-		Width  int `json:"width"`
-		Height int `json:"height"`
-	} `json:"streams"`
-}
-
-func getVideoAspectRatio(filePath string) (string, error) {
-	execCmd := exec.Command("ffprobe", "-v", "error", "-print_format", "json", "-show_streams", filePath)
-	var buf bytes.Buffer
-	execCmd.Stdout = &buf
-
-	err := execCmd.Run()
-	if err != nil {
-		return "", err
-	}
-
-	var video videoParams
-	err = json.Unmarshal(buf.Bytes(), &video)
-	if err != nil {
-		return "", err
-	}
-
-	if len(video.Streams) == 0 {
-		return "", fmt.Errorf("no video streams found")
-	}
-
-	width := video.Streams[0].Width
-	height := video.Streams[0].Height
-
-	if width == 0 || height == 0 {
-		return "", fmt.Errorf("invalid video dimensions")
-	}
-
-	// Calculate aspect ratio
-	ratio := float64(width) / float64(height)
-
-	// Using tolerance for floating point comparison
-	const tolerance = 0.05
-
-	if math.Abs(ratio-16.0/9.0) < tolerance { // ~1.778
-		return "landscape", nil
-	} else if math.Abs(ratio-9.0/16.0) < tolerance { // ~0.5625
-		return "portrait", nil
-	}
-
-	return "other", nil
-}
-
-func processVideoForFastStart(filePath string) (string, error) {
-	outputPath := filePath + ".processing"
-	cmd := exec.Command("ffmpeg", "-i", filePath, "-c", "copy", "-movflags", "faststart", "-f", "mp4", outputPath)
-	err := cmd.Run()
-	if err != nil {
-		return "", err
-	}
-	return outputPath, nil
+	respondWithJSON(w, http.StatusAccepted, cfg.presentVideo(r.Context(), videoMetadata))
 }
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+const videoEventsKeepAlive = 15 * time.Second
+
+// handlerVideoEvents streams the video's processing events to its owner as
+// Server-Sent Events. The first event is where processing stands right now;
+// the stream stays open until the client goes away, clients are expected to
+// close it once they've seen done or failed.
+func (cfg *apiConfig) handlerVideoEvents(w http.ResponseWriter, r *http.Request) {
+	video, ok := cfg.authorizeVideoOwner(w, r)
+	if !ok {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		respondWithError(w, http.StatusInternalServerError, "Streaming isn't supported", nil)
+		return
+	}
+
+	events, unsubscribe := cfg.events.subscribe(video.ID)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	// Keep reverse proxies from buffering the stream.
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	// Nothing in flight, so the database knows best. Read it again now that
+	// we're subscribed, in case processing moved on in the meantime.
+	if len(events) == 0 {
+		video, err := cfg.db.GetVideo(video.ID)
+		if err == nil {
+			if event, ok := videoStatusEvent(video); ok {
+				writeVideoEvent(w, event)
+			}
+		}
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(videoEventsKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event := <-events:
+			writeVideoEvent(w, event)
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		}
+		flusher.Flush()
+	}
+}
+
+func writeVideoEvent(w http.ResponseWriter, event videoEvent) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+}
+
+// videoStatusEvent describes the stored processing status as an event.
+func videoStatusEvent(video database.Video) (videoEvent, bool) {
+	event := videoEvent{Time: video.UpdatedAt}
+	if video.ProcessingError != nil {
+		event.Error = *video.ProcessingError
+	}
+	switch video.ProcessingStatus {
+	case database.ProcessingStatusPending:
+		event.Type = videoEventQueued
+		if video.ProcessingError != nil {
+			event.Type = videoEventRetrying
+		}
+	case database.ProcessingStatusProcessing:
+		event.Type = videoEventProcessing
+	case database.ProcessingStatusReady:
+		event.Type = videoEventDone
+	case database.ProcessingStatusFailed:
+		event.Type = videoEventFailed
+	default:
+		return videoEvent{}, false
+	}
+	return event, true
+}
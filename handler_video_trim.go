@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+)
+
+// handlerVideoTrim cuts a processed video down to one or more ranges, which
+// are joined in order, and queues the result for processing like any
+// upload. By default the trim becomes a new video linked to the source;
+// with replace the video itself is trimmed once processing is done.
+func (cfg *apiConfig) handlerVideoTrim(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		// Start and End, in seconds, are a single range; Ranges are
+		// several. Start defaults to the beginning, End to the end.
+		Start   *float64            `json:"start"`
+		End     *float64            `json:"end"`
+		Ranges  database.TimeRanges `json:"ranges"`
+		Replace bool                `json:"replace"`
+		// Title of the new video, the source's title by default.
+		Title string `json:"title"`
+	}
+
+	video, ok := cfg.authorizeVideoOwner(w, r)
+	if !ok {
+		return
+	}
+
+	params := parameters{}
+	err := json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	if video.VideoURL == nil || video.ProcessingStatus != database.ProcessingStatusReady {
+		respondWithError(w, http.StatusConflict, "Video hasn't been processed yet", nil)
+		return
+	}
+	if video.DurationSeconds == nil || *video.DurationSeconds <= 0 {
+		respondWithError(w, http.StatusConflict, "Video duration is unknown", nil)
+		return
+	}
+	videoKey, ok := cfg.objectKey(*video.VideoURL)
+	if !ok {
+		respondWithError(w, http.StatusConflict, "Video isn't stored in the current storage backend", nil)
+		return
+	}
+
+	ranges := params.Ranges
+	if params.Start != nil || params.End != nil {
+		if len(ranges) > 0 {
+			respondWithError(w, http.StatusBadRequest, "Give either start and end or ranges, not both", nil)
+			return
+		}
+		single := database.TimeRange{End: *video.DurationSeconds}
+		if params.Start != nil {
+			single.Start = *params.Start
+		}
+		if params.End != nil {
+			single.End = *params.End
+		}
+		ranges = database.TimeRanges{single}
+	}
+	ranges, err = checkTrimRanges(ranges, *video.DurationSeconds)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+
+	// The stored video is the source, or the original it was watermarked
+	// from so the watermark isn't burned in twice. The queue picks it up
+	// from uploadsRoot and removes it when it's done.
+	sourceKey := videoKey
+	if video.OriginalKey != nil {
+		sourceKey = *video.OriginalKey
+	}
+	tempFile, err := os.CreateTemp(cfg.uploadsRoot, "trim-*.upload")
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create temp file", err)
+		return
+	}
+	defer tempFile.Close()
+	body, err := cfg.storage.Get(r.Context(), sourceKey)
+	if err != nil {
+		cfg.removeUpload(tempFile.Name())
+		respondWithError(w, http.StatusInternalServerError, "Couldn't download video", err)
+		return
+	}
+	hashed, err := newHashingWriter(cfg.uploadLimits.writer(tempFile), storage.Checksum{})
+	if err != nil {
+		body.Close()
+		cfg.removeUpload(tempFile.Name())
+		respondWithError(w, http.StatusInternalServerError, "Couldn't write to temp file", err)
+		return
+	}
+	_, err = io.Copy(hashed, body)
+	body.Close()
+	if err != nil {
+		cfg.removeUpload(tempFile.Name())
+		respondWithUploadError(w, "Couldn't write to temp file", err)
+		return
+	}
+
+	target := video
+	if !params.Replace {
+		title := params.Title
+		if title == "" {
+			title = video.Title
+		}
+		target, err = cfg.db.CreateDerivedVideo(database.CreateVideoParams{
+			Title:       title,
+			Description: video.Description,
+			Visibility:  video.Visibility,
+			UserID:      video.UserID,
+		}, video.ID)
+		if err != nil {
+			cfg.removeUpload(tempFile.Name())
+			respondWithError(w, http.StatusInternalServerError, "Couldn't create video", err)
+			return
+		}
+	}
+
+	target, err = cfg.enqueueProcessing(r.Context(), target, tempFile.Name(), trimSourceSHA256(hashed.sum(), ranges), ranges, nil)
+	if err != nil {
+		cfg.removeUpload(tempFile.Name())
+		if !params.Replace {
+			deleteErr := cfg.db.DeleteVideo(target.ID)
+			if deleteErr != nil {
+				log.Printf("Couldn't delete video %s after failing to trim into it: %v", target.ID, deleteErr)
+			}
+		}
+		if errors.Is(err, errUnsupportedVideo) {
+			respondWithError(w, http.StatusConflict, fmt.Sprintf("Stored video can't be trimmed: %v", err), err)
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, "Couldn't queue video for processing", err)
+		return
+	}
+
+	if !params.Replace {
+		w.Header().Set("Location", "/api/videos/"+target.ID.String())
+	}
+	respondWithJSON(w, http.StatusAccepted, cfg.presentVideo(r.Context(), target))
+}
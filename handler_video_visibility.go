@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func (cfg *apiConfig) handlerVideoVisibilitySet(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Visibility database.Visibility `json:"visibility"`
+	}
+
+	video, ok := cfg.authorizeVideoOwner(w, r)
+	if !ok {
+		return
+	}
+
+	params := parameters{}
+	err := json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	err = cfg.checkVisibility(params.Visibility)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+
+	err = cfg.db.SetVideoVisibility(video.ID, params.Visibility)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
+		return
+	}
+	video.Visibility = params.Visibility
+
+	respondWithJSON(w, http.StatusOK, cfg.presentVideo(r.Context(), video))
+}
+
+// checkVisibility refuses visibilities this deployment can't enforce: CDN
+// delivery without URL signing only has permanent public links to give out.
+func (cfg *apiConfig) checkVisibility(visibility database.Visibility) error {
+	if !visibility.Valid() {
+		return fmt.Errorf("visibility must be %s, %s or %s", database.VisibilityPublic, database.VisibilityUnlisted, database.VisibilityPrivate)
+	}
+	if visibility != database.VisibilityPublic && cfg.deliveryMode == deliveryModeCDN && cfg.urlSigner == nil {
+		return errors.New("unlisted and private videos need CloudFront URL signing to be configured")
+	}
+	return nil
+}
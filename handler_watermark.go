@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+	"github.com/google/uuid"
+)
+
+type watermarkResponse struct {
+	// Global is set when the user hasn't set a watermark of their own and
+	// the one configured for everyone applies. Its image isn't served.
+	Global   bool    `json:"global"`
+	ImageURL *string `json:"image_url"`
+	Position string  `json:"position"`
+	Opacity  float64 `json:"opacity"`
+	// Reprocessing is how many videos were queued to get the change.
+	Reprocessing int `json:"reprocessing"`
+}
+
+// handlerWatermarkGet returns the watermark the caller's videos get.
+func (cfg *apiConfig) handlerWatermarkGet(w http.ResponseWriter, r *http.Request) {
+	userID, ok := cfg.authenticateUser(w, r)
+	if !ok {
+		return
+	}
+	watermark, err := cfg.db.GetWatermark(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get watermark", err)
+		return
+	}
+	if watermark.UserID != uuid.Nil {
+		respondWithJSON(w, http.StatusOK, cfg.presentWatermark(r.Context(), watermark, 0))
+		return
+	}
+	if cfg.watermark == nil {
+		respondWithError(w, http.StatusNotFound, "No watermark set", nil)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, watermarkResponse{
+		Global:   true,
+		Position: cfg.watermark.position,
+		Opacity:  cfg.watermark.opacity,
+	})
+}
+
+// handlerWatermarkSet sets the caller's own watermark from a multipart form:
+// the JPEG or PNG "image", its "position" and its "opacity". Once set,
+// any of them can be left out to keep what's there. Processed videos are
+// queued to be burned again with it.
+func (cfg *apiConfig) handlerWatermarkSet(w http.ResponseWriter, r *http.Request) {
+	userID, ok := cfg.authenticateUser(w, r)
+	if !ok {
+		return
+	}
+	if !cfg.originalsPrivate {
+		respondWithError(w, http.StatusNotImplemented, "Watermarks aren't available on this server", nil)
+		return
+	}
+	current, err := cfg.db.GetWatermark(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get watermark", err)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, watermarkUploadLimit)
+	err = r.ParseMultipartForm(watermarkUploadLimit)
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			respondWithUploadError(w, "Couldn't read watermark", err)
+			return
+		}
+		respondWithError(w, http.StatusBadRequest, "Couldn't parse form", err)
+		return
+	}
+
+	watermark := current
+	watermark.UserID = userID
+	if watermark.Position == "" {
+		watermark.Position = watermarkBottomRight
+		watermark.Opacity = defaultWatermarkOpacity
+	}
+	if position := r.FormValue("position"); position != "" {
+		watermark.Position = position
+	}
+	if opacity := r.FormValue("opacity"); opacity != "" {
+		watermark.Opacity, err = strconv.ParseFloat(opacity, 64)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Opacity must be a number", err)
+			return
+		}
+	}
+	err = checkWatermarkSettings(watermark.Position, watermark.Opacity)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+
+	released := []database.MediaRelease{}
+	// A new image is ours to clean up until the watermark points at it.
+	var uploadedKey *string
+	defer func() {
+		cfg.releaseMedia(cfg.mediaRelease(uploadedKey))
+	}()
+	file, _, err := r.FormFile("image")
+	if err == nil {
+		defer file.Close()
+		data, err := io.ReadAll(file)
+		if err != nil {
+			respondWithUploadError(w, "Couldn't read image", err)
+			return
+		}
+		data, err = decodeWatermarkImage(data)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error(), err)
+			return
+		}
+		key, err := cfg.putWatermarkImage(r.Context(), userID, data)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't save image", err)
+			return
+		}
+		uploadedKey = &key
+		if current.UserID != uuid.Nil {
+			released = cfg.mediaRelease(&current.ImageURL)
+		}
+		sum := sha256.Sum256(data)
+		watermark.ImageURL = key
+		watermark.ImageSHA256 = hex.EncodeToString(sum[:])
+	} else if current.UserID == uuid.Nil {
+		respondWithError(w, http.StatusBadRequest, "No image provided", err)
+		return
+	}
+
+	saved, err := cfg.db.SetWatermarkReplacingMedia(watermark, released)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save watermark", err)
+		return
+	}
+	uploadedKey = nil
+	cfg.storageCleanup.notify()
+
+	queued := cfg.requeueForWatermark(&userID)
+	respondWithJSON(w, http.StatusOK, cfg.presentWatermark(r.Context(), saved, queued))
+}
+
+// handlerWatermarkDelete removes the caller's own watermark, so their
+// videos get the global one again, or none.
+func (cfg *apiConfig) handlerWatermarkDelete(w http.ResponseWriter, r *http.Request) {
+	userID, ok := cfg.authenticateUser(w, r)
+	if !ok {
+		return
+	}
+	watermark, err := cfg.db.GetWatermark(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get watermark", err)
+		return
+	}
+	if watermark.UserID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "No watermark set", nil)
+		return
+	}
+
+	err = cfg.db.DeleteWatermarkAndMedia(userID, cfg.mediaRelease(&watermark.ImageURL))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't delete watermark", err)
+		return
+	}
+	cfg.storageCleanup.notify()
+	cfg.requeueForWatermark(&userID)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (cfg *apiConfig) authenticateUser(w http.ResponseWriter, r *http.Request) (uuid.UUID, bool) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return uuid.Nil, false
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return uuid.Nil, false
+	}
+	return userID, true
+}
+
+func (cfg *apiConfig) presentWatermark(ctx context.Context, watermark database.Watermark, queued int) watermarkResponse {
+	response := watermarkResponse{
+		Position:     watermark.Position,
+		Opacity:      watermark.Opacity,
+		Reprocessing: queued,
+	}
+	if cfg.deliveryMode != deliveryModePresigned {
+		response.ImageURL = cfg.objectURL(&watermark.ImageURL)
+		return response
+	}
+	if presigner, ok := cfg.storage.(storage.Presigner); ok {
+		presigned, err := presigner.PresignGet(ctx, watermark.ImageURL, cfg.presignedURLTTL)
+		if err == nil {
+			response.ImageURL = &presigned
+		}
+	}
+	return response
+}
@@ -0,0 +1,115 @@
+package cdnsign
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestSigner(t *testing.T) *Signer {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateKeyPEM := pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	})
+	signer, err := NewSigner("KTESTKEYPAIR", privateKeyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func decode(t *testing.T, s string) []byte {
+	t.Helper()
+	if strings.ContainsAny(s, "+=/") {
+		t.Errorf("%q has characters CloudFront doesn't allow", s)
+	}
+	b, err := base64.StdEncoding.DecodeString(strings.NewReplacer("-", "+", "_", "=", "~", "/").Replace(s))
+	if err != nil {
+		t.Fatalf("decoding %q: %v", s, err)
+	}
+	return b
+}
+
+func checkSignature(t *testing.T, signer *Signer, policy []byte, signature string) {
+	t.Helper()
+	hashed := sha1.Sum(policy)
+	err := rsa.VerifyPKCS1v15(&signer.key.PublicKey, crypto.SHA1, hashed[:], decode(t, signature))
+	if err != nil {
+		t.Errorf("signature doesn't match the policy: %v", err)
+	}
+}
+
+func TestSignURL(t *testing.T) {
+	signer := newTestSigner(t)
+	rawURL := "https://d111111abcdef8.cloudfront.net/videos/abc/video.mp4"
+	expires := time.Unix(1700000000, 0)
+
+	signed, err := signer.SignURL(rawURL, expires)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base, query, ok := strings.Cut(signed, "?")
+	if !ok || base != rawURL {
+		t.Fatalf("signed URL %q doesn't start with %q?", signed, rawURL)
+	}
+	params, err := url.ParseQuery(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := params.Get("Expires"); got != strconv.FormatInt(expires.Unix(), 10) {
+		t.Errorf("Expires = %q", got)
+	}
+	if got := params.Get("Key-Pair-Id"); got != "KTESTKEYPAIR" {
+		t.Errorf("Key-Pair-Id = %q", got)
+	}
+	if params.Has("Policy") {
+		t.Error("canned policy URLs shouldn't carry a Policy")
+	}
+
+	want := `{"Statement":[{"Resource":"` + rawURL + `","Condition":{"DateLessThan":{"AWS:EpochTime":1700000000}}}]}`
+	if got := string(cannedPolicy(rawURL, expires)); got != want {
+		t.Errorf("canned policy = %s, want %s", got, want)
+	}
+	checkSignature(t, signer, []byte(want), params.Get("Signature"))
+}
+
+func TestSignURLKeepsQuery(t *testing.T) {
+	signer := newTestSigner(t)
+	signed, err := signer.SignURL("https://cdn.example.com/a.mp4?v=2", time.Unix(1700000000, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(signed, "https://cdn.example.com/a.mp4?v=2&Expires=") {
+		t.Errorf("signed URL = %q", signed)
+	}
+}
+
+func TestEncode(t *testing.T) {
+	// 0xfb 0xff encodes to "+/8=" in standard base64.
+	if got := encode([]byte{0xfb, 0xff}); got != "-~8_" {
+		t.Errorf("encode = %q, want %q", got, "-~8_")
+	}
+}
+
+func TestNewSignerRejects(t *testing.T) {
+	if _, err := NewSigner("", []byte("x")); err == nil {
+		t.Error("empty key pair ID accepted")
+	}
+	if _, err := NewSigner("K", []byte("not a key")); err == nil {
+		t.Error("non-PEM key accepted")
+	}
+}
@@ -0,0 +1,178 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+type BlobKind string
+
+const (
+	// BlobKindVideo blobs are keyed by the hash of the uploaded file and
+	// point at what processing made of it.
+	BlobKindVideo     BlobKind = "video"
+	BlobKindThumbnail BlobKind = "thumbnail"
+	// BlobKindOriginal blobs are uploads kept as they were, see
+	// Video.OriginalKey.
+	BlobKindOriginal BlobKind = "original"
+)
+
+// Blob is stored content shared by every video that uploaded the same bytes.
+// It's removed, together with its objects, when the last reference goes.
+type Blob struct {
+	CreatedAt time.Time
+	RefCount  int
+	CreateBlobParams
+}
+
+type CreateBlobParams struct {
+	Kind   BlobKind
+	SHA256 string
+	Key    string
+	HLSKey *string
+	Size   int64
+	// ChecksumSHA256 is the base64 SHA-256 of the object at Key, which
+	// isn't the uploaded file that SHA256 is the hash of once it has been
+	// processed.
+	ChecksumSHA256 *string
+	// Variants are the sizes of a thumbnail.
+	Variants ImageVariants
+	// ThumbnailTrackKey and SpriteSheets are a video's scrubbing previews.
+	ThumbnailTrackKey *string
+	SpriteSheets      ImageVariants
+	PreviewKey        *string
+	AudioKey          *string
+	WaveformKey       *string
+	// Watermark identifies the watermark burned into a video. A watermarked
+	// video's SHA256 isn't the upload's hash but is derived from it and the
+	// watermark.
+	Watermark *string
+}
+
+const blobColumns = `
+		created_at,
+		ref_count,
+		kind,
+		sha256,
+		storage_key,
+		hls_key,
+		size,
+		checksum_sha256,
+		variants,
+		thumbnail_track_key,
+		sprite_sheets,
+		preview_key,
+		audio_key,
+		waveform_key,
+		watermark`
+
+func scanBlob(row rowScanner) (Blob, error) {
+	var blob Blob
+	err := row.Scan(
+		&blob.CreatedAt,
+		&blob.RefCount,
+		&blob.Kind,
+		&blob.SHA256,
+		&blob.Key,
+		&blob.HLSKey,
+		&blob.Size,
+		&blob.ChecksumSHA256,
+		&blob.Variants,
+		&blob.ThumbnailTrackKey,
+		&blob.SpriteSheets,
+		&blob.PreviewKey,
+		&blob.AudioKey,
+		&blob.WaveformKey,
+		&blob.Watermark,
+	)
+	return blob, err
+}
+
+// AcquireBlob records a new reference to content. If a blob with the same
+// hash already exists its reference count goes up and it's returned as it
+// is, so callers have to check whether their own copy is still needed.
+func (c Client) AcquireBlob(params CreateBlobParams) (Blob, error) {
+	query := `
+	INSERT INTO blobs (
+		created_at,
+		ref_count,
+		kind,
+		sha256,
+		storage_key,
+		hls_key,
+		size,
+		checksum_sha256,
+		variants,
+		thumbnail_track_key,
+		sprite_sheets,
+		preview_key,
+		audio_key,
+		waveform_key,
+		watermark
+	) VALUES (?, 1, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	ON CONFLICT (kind, sha256) DO UPDATE SET ref_count = ref_count + 1
+	RETURNING` + blobColumns
+
+	return scanBlob(c.db.QueryRow(query, dbNow(), params.Kind, params.SHA256, params.Key, params.HLSKey, params.Size, params.ChecksumSHA256, params.Variants, params.ThumbnailTrackKey, params.SpriteSheets, params.PreviewKey, params.AudioKey, params.WaveformKey, params.Watermark))
+}
+
+// ReuseBlob adds a reference to an existing blob. The returned blob has an
+// empty Key if there's no blob with that hash.
+func (c Client) ReuseBlob(kind BlobKind, sha256 string) (Blob, error) {
+	query := `
+	UPDATE blobs
+	SET ref_count = ref_count + 1
+	WHERE kind = ? AND sha256 = ?
+	RETURNING` + blobColumns
+
+	blob, err := scanBlob(c.db.QueryRow(query, kind, sha256))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Blob{}, nil
+	}
+	return blob, err
+}
+
+// MediaRelease is an object a video stops pointing at. If the object
+// belongs to a blob only the video's reference is dropped, and Deletions
+// are queued once nothing references the blob any more; objects outside
+// blobs are deleted straight away.
+type MediaRelease struct {
+	Key       string
+	Deletions []StorageDeletionParams
+}
+
+func (c Client) ReleaseMedia(released []MediaRelease) error {
+	return c.inTx(func(tx *sql.Tx) error {
+		return releaseMedia(tx, released)
+	})
+}
+
+func releaseMedia(tx *sql.Tx, released []MediaRelease) error {
+	for _, release := range released {
+		var refCount int
+		err := tx.QueryRow(`
+		UPDATE blobs
+		SET ref_count = ref_count - 1
+		WHERE storage_key = ?
+		RETURNING ref_count
+		`, release.Key).Scan(&refCount)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		if err == nil {
+			if refCount > 0 {
+				continue
+			}
+			_, err = tx.Exec("DELETE FROM blobs WHERE storage_key = ?", release.Key)
+			if err != nil {
+				return err
+			}
+		}
+		err = queueStorageDeletions(tx, release.Deletions)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
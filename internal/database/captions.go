@@ -0,0 +1,138 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Caption is a WebVTT caption or subtitle track of a video. URL holds a
+// storage key in the database, like the video's media.
+type Caption struct {
+	ID        uuid.UUID `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	CreateCaptionParams
+}
+
+type CreateCaptionParams struct {
+	VideoID uuid.UUID `json:"video_id"`
+	// Language is a BCP 47 tag such as "en" or "pt-BR".
+	Language string `json:"language"`
+	Label    string `json:"label"`
+	URL      string `json:"url"`
+}
+
+const captionColumns = `
+		id,
+		created_at,
+		updated_at,
+		video_id,
+		language,
+		label,
+		storage_key`
+
+func scanCaption(row rowScanner) (Caption, error) {
+	var caption Caption
+	err := row.Scan(
+		&caption.ID,
+		&caption.CreatedAt,
+		&caption.UpdatedAt,
+		&caption.VideoID,
+		&caption.Language,
+		&caption.Label,
+		&caption.URL,
+	)
+	return caption, err
+}
+
+func (c Client) CreateCaption(params CreateCaptionParams) (Caption, error) {
+	query := `
+	INSERT INTO captions (
+		id,
+		created_at,
+		updated_at,
+		video_id,
+		language,
+		label,
+		storage_key
+	) VALUES (?, ?, ?, ?, ?, ?, ?)
+	RETURNING` + captionColumns
+
+	now := dbNow()
+	return scanCaption(c.db.QueryRow(query, uuid.New(), now, now, params.VideoID, params.Language, params.Label, params.URL))
+}
+
+// GetCaption returns the caption, or one with a zero ID if there's none.
+func (c Client) GetCaption(id uuid.UUID) (Caption, error) {
+	query := `
+	SELECT` + captionColumns + `
+	FROM captions
+	WHERE id = ?
+	`
+	caption, err := scanCaption(c.db.QueryRow(query, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Caption{}, nil
+	}
+	return caption, err
+}
+
+// GetCaptions lists the video's captions, oldest first.
+func (c Client) GetCaptions(videoID uuid.UUID) ([]Caption, error) {
+	query := `
+	SELECT` + captionColumns + `
+	FROM captions
+	WHERE video_id = ?
+	ORDER BY created_at, id
+	`
+	rows, err := c.db.Query(query, videoID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	captions := []Caption{}
+	for rows.Next() {
+		caption, err := scanCaption(rows)
+		if err != nil {
+			return nil, err
+		}
+		captions = append(captions, caption)
+	}
+	return captions, rows.Err()
+}
+
+// UpdateCaptionReplacingMedia updates the caption and releases the objects
+// it no longer points at, atomically.
+func (c Client) UpdateCaptionReplacingMedia(caption Caption, released []MediaRelease) error {
+	return c.inTx(func(tx *sql.Tx) error {
+		query := `
+		UPDATE captions
+		SET
+			updated_at = ?,
+			language = ?,
+			label = ?,
+			storage_key = ?
+		WHERE id = ?
+		`
+		_, err := tx.Exec(query, dbNow(), caption.Language, caption.Label, caption.URL, caption.ID)
+		if err != nil {
+			return err
+		}
+		return releaseMedia(tx, released)
+	})
+}
+
+// DeleteCaptionAndMedia deletes the caption and releases its stored
+// objects, atomically.
+func (c Client) DeleteCaptionAndMedia(id uuid.UUID, released []MediaRelease) error {
+	return c.inTx(func(tx *sql.Tx) error {
+		_, err := tx.Exec("DELETE FROM captions WHERE id = ?", id)
+		if err != nil {
+			return err
+		}
+		return releaseMedia(tx, released)
+	})
+}
@@ -3,6 +3,7 @@ package database
 import (
 	"database/sql"
 	"fmt"
+	"strings"
 
 	_ "github.com/mattn/go-sqlite3"
 )
@@ -12,6 +13,11 @@ type Client struct {
 }
 
 func NewClient(pathToDB string) (Client, error) {
+	// Background workers write alongside request handlers, so wait for
+	// locks instead of failing straight away with SQLITE_BUSY.
+	if !strings.Contains(pathToDB, "?") {
+		pathToDB += "?_busy_timeout=5000"
+	}
 	db, err := sql.Open("sqlite3", pathToDB)
 	if err != nil {
 		return Client{}, err
@@ -72,10 +78,342 @@ func (c *Client) autoMigrate() error {
 	if err != nil {
 		return err
 	}
+	err = c.addColumnIfMissing("videos", "processing_status", "TEXT NOT NULL DEFAULT ''")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfMissing("videos", "processing_error", "TEXT")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfMissing("videos", "hls_url", "TEXT")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfMissing("videos", "visibility", "TEXT NOT NULL DEFAULT 'public'")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfMissing("videos", "thumbnail_variants", "TEXT")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfMissing("videos", "thumbnail_checksum_sha256", "TEXT")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfMissing("videos", "video_checksum_sha256", "TEXT")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfMissing("videos", "thumbnail_track_url", "TEXT")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfMissing("videos", "sprite_sheets", "TEXT")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfMissing("videos", "preview_url", "TEXT")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfMissing("videos", "audio_url", "TEXT")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfMissing("videos", "waveform_url", "TEXT")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfMissing("videos", "source_video_id", "TEXT")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfMissing("videos", "original_key", "TEXT")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfMissing("videos", "watermark", "TEXT")
+	if err != nil {
+		return err
+	}
+	metadataColumns := []struct{ name, definition string }{
+		{"duration_seconds", "REAL"},
+		{"container", "TEXT"},
+		{"video_codec", "TEXT"},
+		{"audio_codec", "TEXT"},
+		{"bitrate", "INTEGER"},
+		{"frame_rate", "REAL"},
+		{"rotation", "INTEGER"},
+		{"width", "INTEGER"},
+		{"height", "INTEGER"},
+	}
+	for _, column := range metadataColumns {
+		err = c.addColumnIfMissing("videos", column.name, column.definition)
+		if err != nil {
+			return err
+		}
+	}
+
+	uploadSessionTable := `
+	CREATE TABLE IF NOT EXISTS upload_sessions (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		video_id TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		upload_length INTEGER NOT NULL,
+		upload_offset INTEGER NOT NULL DEFAULT 0,
+		media_type TEXT NOT NULL,
+		file_path TEXT NOT NULL,
+		completed_at TIMESTAMP,
+		FOREIGN KEY(video_id) REFERENCES videos(id) ON DELETE CASCADE,
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	_, err = c.db.Exec(uploadSessionTable)
+	if err != nil {
+		return err
+	}
+
+	processingJobTable := `
+	CREATE TABLE IF NOT EXISTS processing_jobs (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		video_id TEXT NOT NULL,
+		source_path TEXT NOT NULL,
+		media_type TEXT NOT NULL,
+		status TEXT NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		last_error TEXT,
+		run_after TIMESTAMP NOT NULL,
+		FOREIGN KEY(video_id) REFERENCES videos(id) ON DELETE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS processing_jobs_status_run_after ON processing_jobs(status, run_after);
+	`
+	_, err = c.db.Exec(processingJobTable)
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfMissing("processing_jobs", "source_sha256", "TEXT NOT NULL DEFAULT ''")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfMissing("processing_jobs", "trim_ranges", "TEXT")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfMissing("processing_jobs", "reprocess", "BOOLEAN NOT NULL DEFAULT FALSE")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfMissing("processing_jobs", "watermark", "TEXT")
+	if err != nil {
+		return err
+	}
+
+	storageDeletionTable := `
+	CREATE TABLE IF NOT EXISTS storage_deletions (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP NOT NULL,
+		storage_key TEXT NOT NULL,
+		prefix BOOLEAN NOT NULL DEFAULT FALSE,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		last_error TEXT,
+		run_after TIMESTAMP NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS storage_deletions_run_after ON storage_deletions(run_after);
+	`
+	_, err = c.db.Exec(storageDeletionTable)
+	if err != nil {
+		return err
+	}
+
+	blobTable := `
+	CREATE TABLE IF NOT EXISTS blobs (
+		kind TEXT NOT NULL,
+		sha256 TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL,
+		ref_count INTEGER NOT NULL,
+		storage_key TEXT NOT NULL UNIQUE,
+		hls_key TEXT,
+		size INTEGER NOT NULL,
+		PRIMARY KEY (kind, sha256)
+	);
+	`
+	_, err = c.db.Exec(blobTable)
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfMissing("blobs", "checksum_sha256", "TEXT")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfMissing("blobs", "variants", "TEXT")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfMissing("blobs", "thumbnail_track_key", "TEXT")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfMissing("blobs", "sprite_sheets", "TEXT")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfMissing("blobs", "preview_key", "TEXT")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfMissing("blobs", "audio_key", "TEXT")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfMissing("blobs", "waveform_key", "TEXT")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfMissing("blobs", "watermark", "TEXT")
+	if err != nil {
+		return err
+	}
+
+	captionTable := `
+	CREATE TABLE IF NOT EXISTS captions (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP NOT NULL,
+		updated_at TIMESTAMP NOT NULL,
+		video_id TEXT NOT NULL,
+		language TEXT NOT NULL,
+		label TEXT NOT NULL,
+		storage_key TEXT NOT NULL,
+		FOREIGN KEY(video_id) REFERENCES videos(id) ON DELETE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS captions_video_id ON captions(video_id);
+	`
+	_, err = c.db.Exec(captionTable)
+	if err != nil {
+		return err
+	}
+
+	watermarkTable := `
+	CREATE TABLE IF NOT EXISTS watermarks (
+		user_id TEXT PRIMARY KEY,
+		created_at TIMESTAMP NOT NULL,
+		updated_at TIMESTAMP NOT NULL,
+		image_key TEXT NOT NULL,
+		image_sha256 TEXT NOT NULL,
+		position TEXT NOT NULL,
+		opacity REAL NOT NULL,
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	_, err = c.db.Exec(watermarkTable)
+	if err != nil {
+		return err
+	}
+
+	// Data migrations that need the application's configuration run from
+	// main; this only records which ones are done.
+	dataMigrationTable := `
+	CREATE TABLE IF NOT EXISTS data_migrations (
+		name TEXT PRIMARY KEY,
+		applied_at TIMESTAMP NOT NULL
+	);
+	`
+	_, err = c.db.Exec(dataMigrationTable)
+	if err != nil {
+		return err
+	}
 	return nil
 }
 
+func (c Client) DataMigrationApplied(name string) (bool, error) {
+	var count int
+	err := c.db.QueryRow("SELECT COUNT(*) FROM data_migrations WHERE name = ?", name).Scan(&count)
+	return count > 0, err
+}
+
+func (c Client) MarkDataMigrationApplied(name string) error {
+	_, err := c.db.Exec("INSERT OR IGNORE INTO data_migrations (name, applied_at) VALUES (?, ?)", name, dbNow())
+	return err
+}
+
+// execer is satisfied by both *sql.DB and *sql.Tx.
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+// inTx runs fn in a transaction, committing if it returns nil.
+func (c Client) inTx(fn func(tx *sql.Tx) error) error {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	err = fn(tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// addColumnIfMissing lets autoMigrate grow tables that were created by an
+// older version of the schema.
+func (c *Client) addColumnIfMissing(table, column, definition string) error {
+	rows, err := c.db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid          int
+			name         string
+			columnType   string
+			notNull      bool
+			defaultValue sql.NullString
+			primaryKey   int
+		)
+		err := rows.Scan(&cid, &name, &columnType, &notNull, &defaultValue, &primaryKey)
+		if err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	_, err = c.db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
+
 func (c Client) Reset() error {
+	if _, err := c.db.Exec("DELETE FROM watermarks"); err != nil {
+		return fmt.Errorf("failed to reset table watermarks: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM captions"); err != nil {
+		return fmt.Errorf("failed to reset table captions: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM blobs"); err != nil {
+		return fmt.Errorf("failed to reset table blobs: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM storage_deletions"); err != nil {
+		return fmt.Errorf("failed to reset table storage_deletions: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM processing_jobs"); err != nil {
+		return fmt.Errorf("failed to reset table processing_jobs: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM upload_sessions"); err != nil {
+		return fmt.Errorf("failed to reset table upload_sessions: %w", err)
+	}
 	if _, err := c.db.Exec("DELETE FROM refresh_tokens"); err != nil {
 		return fmt.Errorf("failed to reset table refresh_tokens: %w", err)
 	}
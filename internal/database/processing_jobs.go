@@ -0,0 +1,250 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type JobStatus string
+
+const (
+	JobStatusPending    JobStatus = "pending"
+	JobStatusProcessing JobStatus = "processing"
+	JobStatusDone       JobStatus = "done"
+	JobStatusFailed     JobStatus = "failed"
+)
+
+type ProcessingJob struct {
+	ID        uuid.UUID `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Status    JobStatus `json:"status"`
+	Attempts  int       `json:"attempts"`
+	LastError *string   `json:"last_error"`
+	RunAfter  time.Time `json:"run_after"`
+	CreateProcessingJobParams
+}
+
+type CreateProcessingJobParams struct {
+	VideoID    uuid.UUID `json:"video_id"`
+	SourcePath string    `json:"-"`
+	// SourceSHA256 is the hash of the uploaded file, see BlobKindVideo.
+	SourceSHA256 string `json:"-"`
+	MediaType    string `json:"media_type"`
+	// Trim, if set, are the parts of the source to keep, concatenated.
+	Trim TimeRanges `json:"trim,omitempty"`
+	// Reprocess jobs have no upload: the source is the video's original,
+	// or its stored video if it has none, fetched when the job runs.
+	Reprocess bool `json:"reprocess,omitempty"`
+	// Watermark is the fingerprint of the watermark a reprocess job was
+	// queued to burn in, nil for none.
+	Watermark *string `json:"-"`
+	// UploadSessionID, if set, is the resumable upload the source was
+	// assembled by. It is marked complete together with creating the job,
+	// so the file is never owned by both or by neither.
+	UploadSessionID *uuid.UUID `json:"-"`
+}
+
+const processingJobColumns = `
+		id,
+		created_at,
+		updated_at,
+		video_id,
+		source_path,
+		source_sha256,
+		media_type,
+		trim_ranges,
+		reprocess,
+		watermark,
+		status,
+		attempts,
+		last_error,
+		run_after`
+
+func scanProcessingJob(row rowScanner) (ProcessingJob, error) {
+	var job ProcessingJob
+	err := row.Scan(
+		&job.ID,
+		&job.CreatedAt,
+		&job.UpdatedAt,
+		&job.VideoID,
+		&job.SourcePath,
+		&job.SourceSHA256,
+		&job.MediaType,
+		&job.Trim,
+		&job.Reprocess,
+		&job.Watermark,
+		&job.Status,
+		&job.Attempts,
+		&job.LastError,
+		&job.RunAfter,
+	)
+	return job, err
+}
+
+// dbNow is truncated to whole seconds so stored timestamps compare correctly
+// as text.
+func dbNow() time.Time {
+	return time.Now().UTC().Truncate(time.Second)
+}
+
+func (c Client) CreateProcessingJob(params CreateProcessingJobParams) (ProcessingJob, error) {
+	id := uuid.New()
+	query := `
+	INSERT INTO processing_jobs (
+		id,
+		created_at,
+		updated_at,
+		video_id,
+		source_path,
+		source_sha256,
+		media_type,
+		trim_ranges,
+		reprocess,
+		watermark,
+		status,
+		attempts,
+		run_after
+	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?, ?, ?, ?, ?, ?, 0, ?)
+	`
+	err := c.inTx(func(tx *sql.Tx) error {
+		_, err := tx.Exec(query, id, params.VideoID, params.SourcePath, params.SourceSHA256, params.MediaType, params.Trim, params.Reprocess, params.Watermark, JobStatusPending, dbNow())
+		if err != nil {
+			return err
+		}
+		if params.UploadSessionID == nil {
+			return nil
+		}
+		return completeUploadSession(tx, *params.UploadSessionID)
+	})
+	if err != nil {
+		return ProcessingJob{}, err
+	}
+
+	return c.GetProcessingJob(id)
+}
+
+func (c Client) GetProcessingJob(id uuid.UUID) (ProcessingJob, error) {
+	query := `
+	SELECT` + processingJobColumns + `
+	FROM processing_jobs
+	WHERE id = ?
+	`
+	job, err := scanProcessingJob(c.db.QueryRow(query, id))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ProcessingJob{}, nil
+		}
+		return ProcessingJob{}, err
+	}
+	return job, nil
+}
+
+func (c Client) GetLatestProcessingJob(videoID uuid.UUID) (ProcessingJob, error) {
+	query := `
+	SELECT` + processingJobColumns + `
+	FROM processing_jobs
+	WHERE video_id = ?
+	ORDER BY created_at DESC
+	LIMIT 1
+	`
+	job, err := scanProcessingJob(c.db.QueryRow(query, videoID))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ProcessingJob{}, nil
+		}
+		return ProcessingJob{}, err
+	}
+	return job, nil
+}
+
+// ClaimProcessingJob atomically moves the oldest runnable pending job to
+// processing and returns it. The returned job has ID uuid.Nil if nothing is
+// ready to run.
+func (c Client) ClaimProcessingJob() (ProcessingJob, error) {
+	query := `
+	UPDATE processing_jobs
+	SET
+		status = ?,
+		attempts = attempts + 1,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = (
+		SELECT id FROM processing_jobs
+		WHERE status = ? AND run_after <= ?
+		ORDER BY run_after
+		LIMIT 1
+	)
+	RETURNING` + processingJobColumns
+
+	job, err := scanProcessingJob(c.db.QueryRow(query, JobStatusProcessing, JobStatusPending, dbNow()))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ProcessingJob{}, nil
+		}
+		return ProcessingJob{}, err
+	}
+	return job, nil
+}
+
+func (c Client) CompleteProcessingJob(id uuid.UUID) error {
+	query := `
+	UPDATE processing_jobs
+	SET
+		status = ?,
+		last_error = NULL,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, JobStatusDone, id)
+	return err
+}
+
+// RetryProcessingJob puts a failed job back in the queue to run again after
+// delay.
+func (c Client) RetryProcessingJob(id uuid.UUID, lastError string, delay time.Duration) error {
+	query := `
+	UPDATE processing_jobs
+	SET
+		status = ?,
+		last_error = ?,
+		run_after = ?,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, JobStatusPending, lastError, dbNow().Add(delay), id)
+	return err
+}
+
+func (c Client) FailProcessingJob(id uuid.UUID, lastError string) error {
+	query := `
+	UPDATE processing_jobs
+	SET
+		status = ?,
+		last_error = ?,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, JobStatusFailed, lastError, id)
+	return err
+}
+
+// RequeueInterruptedProcessingJobs returns jobs left in processing by a
+// previous run of the server to the queue. Only call it before starting
+// any workers.
+func (c Client) RequeueInterruptedProcessingJobs() (int64, error) {
+	query := `
+	UPDATE processing_jobs
+	SET
+		status = ?,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE status = ?
+	`
+	result, err := c.db.Exec(query, JobStatusPending, JobStatusProcessing)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,115 @@
+package database
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// StorageDeletion is an entry in the outbox of stored objects to delete.
+// Entries are written in the same transaction as the change that made the
+// objects unreachable, so nothing is forgotten if the delete itself fails.
+type StorageDeletion struct {
+	ID        uuid.UUID
+	CreatedAt time.Time
+	Attempts  int
+	LastError *string
+	RunAfter  time.Time
+	StorageDeletionParams
+}
+
+type StorageDeletionParams struct {
+	Key string
+	// Prefix deletes every object whose key starts with Key.
+	Prefix bool
+}
+
+const storageDeletionColumns = `
+		id,
+		created_at,
+		storage_key,
+		prefix,
+		attempts,
+		last_error,
+		run_after`
+
+func scanStorageDeletion(row rowScanner) (StorageDeletion, error) {
+	var deletion StorageDeletion
+	err := row.Scan(
+		&deletion.ID,
+		&deletion.CreatedAt,
+		&deletion.Key,
+		&deletion.Prefix,
+		&deletion.Attempts,
+		&deletion.LastError,
+		&deletion.RunAfter,
+	)
+	return deletion, err
+}
+
+func queueStorageDeletions(db execer, deletions []StorageDeletionParams) error {
+	query := `
+	INSERT INTO storage_deletions (
+		id,
+		created_at,
+		storage_key,
+		prefix,
+		run_after
+	) VALUES (?, ?, ?, ?, ?)
+	`
+	now := dbNow()
+	for _, deletion := range deletions {
+		_, err := db.Exec(query, uuid.New(), now, deletion.Key, deletion.Prefix, now)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetDueStorageDeletions returns up to limit deletions that are ready to be
+// attempted, oldest first.
+func (c Client) GetDueStorageDeletions(limit int) ([]StorageDeletion, error) {
+	query := `
+	SELECT` + storageDeletionColumns + `
+	FROM storage_deletions
+	WHERE run_after <= ?
+	ORDER BY run_after
+	LIMIT ?
+	`
+	rows, err := c.db.Query(query, dbNow(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deletions := []StorageDeletion{}
+	for rows.Next() {
+		deletion, err := scanStorageDeletion(rows)
+		if err != nil {
+			return nil, err
+		}
+		deletions = append(deletions, deletion)
+	}
+	return deletions, rows.Err()
+}
+
+// CompleteStorageDeletion removes a deletion that went through.
+func (c Client) CompleteStorageDeletion(id uuid.UUID) error {
+	_, err := c.db.Exec("DELETE FROM storage_deletions WHERE id = ?", id)
+	return err
+}
+
+// RetryStorageDeletion schedules another attempt after delay.
+func (c Client) RetryStorageDeletion(id uuid.UUID, lastError string, delay time.Duration) error {
+	query := `
+	UPDATE storage_deletions
+	SET
+		attempts = attempts + 1,
+		last_error = ?,
+		run_after = ?
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, lastError, dbNow().Add(delay), id)
+	return err
+}
@@ -0,0 +1,196 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type UploadSession struct {
+	ID          uuid.UUID  `json:"id"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	Offset      int64      `json:"offset"`
+	FilePath    string     `json:"-"`
+	CompletedAt *time.Time `json:"completed_at"`
+	CreateUploadSessionParams
+}
+
+type CreateUploadSessionParams struct {
+	VideoID   uuid.UUID `json:"video_id"`
+	UserID    uuid.UUID `json:"user_id"`
+	Length    int64     `json:"length"`
+	MediaType string    `json:"media_type"`
+}
+
+func (c Client) CreateUploadSession(params CreateUploadSessionParams, filePath string) (UploadSession, error) {
+	id := uuid.New()
+	query := `
+	INSERT INTO upload_sessions (
+		id,
+		created_at,
+		updated_at,
+		video_id,
+		user_id,
+		upload_length,
+		upload_offset,
+		media_type,
+		file_path
+	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?, 0, ?, ?)
+	`
+	_, err := c.db.Exec(query, id, params.VideoID, params.UserID, params.Length, params.MediaType, filePath)
+	if err != nil {
+		return UploadSession{}, err
+	}
+
+	return c.GetUploadSession(id)
+}
+
+const uploadSessionColumns = `
+		id,
+		created_at,
+		updated_at,
+		video_id,
+		user_id,
+		upload_length,
+		upload_offset,
+		media_type,
+		file_path,
+		completed_at`
+
+func scanUploadSession(row rowScanner) (UploadSession, error) {
+	var session UploadSession
+	err := row.Scan(
+		&session.ID,
+		&session.CreatedAt,
+		&session.UpdatedAt,
+		&session.VideoID,
+		&session.UserID,
+		&session.Length,
+		&session.Offset,
+		&session.MediaType,
+		&session.FilePath,
+		&session.CompletedAt,
+	)
+	return session, err
+}
+
+func (c Client) GetUploadSession(id uuid.UUID) (UploadSession, error) {
+	query := `
+	SELECT` + uploadSessionColumns + `
+	FROM upload_sessions
+	WHERE id = ?
+	`
+
+	session, err := scanUploadSession(c.db.QueryRow(query, id))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return UploadSession{}, nil
+		}
+		return UploadSession{}, err
+	}
+
+	return session, nil
+}
+
+// GetStaleUploadSessions returns the sessions nothing has happened to since
+// before.
+func (c Client) GetStaleUploadSessions(before time.Time) ([]UploadSession, error) {
+	query := `
+	SELECT` + uploadSessionColumns + `
+	FROM upload_sessions
+	WHERE updated_at < ?
+	`
+	rows, err := c.db.Query(query, before.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []UploadSession{}
+	for rows.Next() {
+		session, err := scanUploadSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+// GetOwnedUploadPaths returns the files in the uploads directory that are
+// still needed: those of upload sessions and the sources of jobs that
+// haven't finished.
+func (c Client) GetOwnedUploadPaths() ([]string, error) {
+	query := `
+	SELECT file_path FROM upload_sessions
+	UNION
+	SELECT source_path FROM processing_jobs
+	WHERE source_path != '' AND status IN (?, ?)
+	`
+	rows, err := c.db.Query(query, JobStatusPending, JobStatusProcessing)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	paths := []string{}
+	for rows.Next() {
+		var filePath string
+		err := rows.Scan(&filePath)
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, filePath)
+	}
+	return paths, rows.Err()
+}
+
+func (c Client) UpdateUploadSessionOffset(id uuid.UUID, offset int64) error {
+	query := `
+	UPDATE upload_sessions
+	SET
+		upload_offset = ?,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, offset, id)
+	return err
+}
+
+// ErrUploadSessionClosed is returned when completing an upload session that
+// was already completed or deleted.
+var ErrUploadSessionClosed = errors.New("upload session is no longer open")
+
+func completeUploadSession(db execer, id uuid.UUID) error {
+	query := `
+	UPDATE upload_sessions
+	SET
+		completed_at = CURRENT_TIMESTAMP,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ? AND completed_at IS NULL
+	`
+	result, err := db.Exec(query, id)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrUploadSessionClosed
+	}
+	return nil
+}
+
+func (c Client) DeleteUploadSession(id uuid.UUID) error {
+	query := `
+	DELETE FROM upload_sessions
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, id)
+	return err
+}
@@ -2,38 +2,251 @@ package database
 
 import (
 	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"time"
 
 	"github.com/google/uuid"
 )
 
+type ProcessingStatus string
+
+const (
+	ProcessingStatusPending    ProcessingStatus = "pending"
+	ProcessingStatusProcessing ProcessingStatus = "processing"
+	ProcessingStatusReady      ProcessingStatus = "ready"
+	ProcessingStatusFailed     ProcessingStatus = "failed"
+)
+
+// Visibility controls who can watch a video. Unlisted and private videos are
+// only ever handed out as short-lived signed URLs; private ones only to their
+// owner.
+type Visibility string
+
+const (
+	VisibilityPublic   Visibility = "public"
+	VisibilityUnlisted Visibility = "unlisted"
+	VisibilityPrivate  Visibility = "private"
+)
+
+func (v Visibility) Valid() bool {
+	switch v {
+	case VisibilityPublic, VisibilityUnlisted, VisibilityPrivate:
+		return true
+	}
+	return false
+}
+
+// Video.ThumbnailURL, VideoURL and HLSURL hold storage keys in the database;
+// the API fills in URLs for the current deployment when responding.
 type Video struct {
 	ID           uuid.UUID `json:"id"`
 	CreatedAt    time.Time `json:"created_at"`
 	UpdatedAt    time.Time `json:"updated_at"`
 	ThumbnailURL *string   `json:"thumbnail_url"`
-	VideoURL     *string   `json:"video_url"`
+	// ThumbnailVariants are the thumbnail's sizes, smallest first; the last
+	// one is ThumbnailURL. Thumbnails stored before variants existed have
+	// none.
+	ThumbnailVariants ImageVariants `json:"thumbnail_variants"`
+	VideoURL          *string       `json:"video_url"`
+	HLSURL            *string       `json:"hls_url"`
+	// ThumbnailTrackURL is a WebVTT track of scrubbing previews, its cues
+	// point into SpriteSheets.
+	ThumbnailTrackURL *string       `json:"thumbnail_track_url"`
+	SpriteSheets      ImageVariants `json:"sprite_sheets"`
+	// PreviewURL is a few muted seconds of the video for hover previews.
+	PreviewURL *string `json:"preview_url"`
+	// AudioURL is an audio only rendition and WaveformURL its peaks, in
+	// audiowaveform's JSON format. Both are nil for videos without audio.
+	AudioURL    *string `json:"audio_url"`
+	WaveformURL *string `json:"waveform_url"`
+	// ThumbnailChecksumSHA256 and VideoChecksumSHA256 are the base64 SHA-256
+	// of the stored objects, for audits. They're nil for media stored
+	// before checksums were recorded.
+	ThumbnailChecksumSHA256 *string          `json:"thumbnail_checksum_sha256"`
+	VideoChecksumSHA256     *string          `json:"video_checksum_sha256"`
+	ProcessingStatus        ProcessingStatus `json:"processing_status,omitempty"`
+	ProcessingError         *string          `json:"processing_error"`
+	// SourceVideoID is the video this one was cut from, if it's a trim that
+	// was made into a video of its own and the source still exists.
+	SourceVideoID *uuid.UUID `json:"source_video_id"`
+	// OriginalKey is the upload as it was, kept while a watermark is burned
+	// into the stored video so it can be processed again. It's never handed
+	// out.
+	OriginalKey *string `json:"-"`
+	// Watermark identifies the watermark burned into the video, if any.
+	Watermark *string `json:"-"`
+	// Captions aren't stored with the video, the API fills them in.
+	Captions []Caption `json:"captions,omitempty"`
 	CreateVideoParams
+	VideoMetadata
+}
+
+// VideoMetadata is what ffprobe told us about the uploaded file. Every field
+// is nil until the video has been uploaded and probed.
+type VideoMetadata struct {
+	DurationSeconds *float64 `json:"duration_seconds"`
+	Container       *string  `json:"container"`
+	VideoCodec      *string  `json:"video_codec"`
+	AudioCodec      *string  `json:"audio_codec"`
+	Bitrate         *int64   `json:"bitrate"`
+	FrameRate       *float64 `json:"frame_rate"`
+	Rotation        *int     `json:"rotation"`
+	Width           *int     `json:"width"`
+	Height          *int     `json:"height"`
+}
+
+// ImageVariant is one size of an image. URL holds a storage key in the
+// database, like the other media fields.
+type ImageVariant struct {
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	URL    string `json:"url"`
+}
+
+// TimeRange is a part of a video, in seconds from its start.
+type TimeRange struct {
+	Start float64 `json:"start"`
+	End   float64 `json:"end"`
+}
+
+// TimeRanges is stored as a JSON array.
+type TimeRanges []TimeRange
+
+func (r TimeRanges) Value() (driver.Value, error) {
+	if r == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(r)
+	return string(data), err
+}
+
+func (r *TimeRanges) Scan(src any) error {
+	switch src := src.(type) {
+	case nil:
+		*r = nil
+		return nil
+	case string:
+		return json.Unmarshal([]byte(src), r)
+	case []byte:
+		return json.Unmarshal(src, r)
+	}
+	return fmt.Errorf("can't scan %T into TimeRanges", src)
+}
+
+// ImageVariants is stored as a JSON array.
+type ImageVariants []ImageVariant
+
+func (v ImageVariants) Value() (driver.Value, error) {
+	if v == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(v)
+	return string(data), err
+}
+
+func (v *ImageVariants) Scan(src any) error {
+	switch src := src.(type) {
+	case nil:
+		*v = nil
+		return nil
+	case string:
+		return json.Unmarshal([]byte(src), v)
+	case []byte:
+		return json.Unmarshal(src, v)
+	}
+	return fmt.Errorf("can't scan %T into ImageVariants", src)
 }
 
 type CreateVideoParams struct {
-	Title       string    `json:"title"`
-	Description string    `json:"description"`
-	UserID      uuid.UUID `json:"user_id"`
+	Title       string     `json:"title"`
+	Description string     `json:"description"`
+	Visibility  Visibility `json:"visibility"`
+	UserID      uuid.UUID  `json:"user_id"`
 }
 
-func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
-	query := `
-	SELECT
+const videoColumns = `
 		id,
 		created_at,
 		updated_at,
 		title,
 		description,
 		thumbnail_url,
+		thumbnail_variants,
 		video_url,
-		user_id
+		hls_url,
+		thumbnail_track_url,
+		sprite_sheets,
+		preview_url,
+		audio_url,
+		waveform_url,
+		thumbnail_checksum_sha256,
+		video_checksum_sha256,
+		processing_status,
+		processing_error,
+		source_video_id,
+		original_key,
+		watermark,
+		duration_seconds,
+		container,
+		video_codec,
+		audio_codec,
+		bitrate,
+		frame_rate,
+		rotation,
+		width,
+		height,
+		visibility,
+		user_id`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanVideo(row rowScanner) (Video, error) {
+	var video Video
+	err := row.Scan(
+		&video.ID,
+		&video.CreatedAt,
+		&video.UpdatedAt,
+		&video.Title,
+		&video.Description,
+		&video.ThumbnailURL,
+		&video.ThumbnailVariants,
+		&video.VideoURL,
+		&video.HLSURL,
+		&video.ThumbnailTrackURL,
+		&video.SpriteSheets,
+		&video.PreviewURL,
+		&video.AudioURL,
+		&video.WaveformURL,
+		&video.ThumbnailChecksumSHA256,
+		&video.VideoChecksumSHA256,
+		&video.ProcessingStatus,
+		&video.ProcessingError,
+		&video.SourceVideoID,
+		&video.OriginalKey,
+		&video.Watermark,
+		&video.DurationSeconds,
+		&video.Container,
+		&video.VideoCodec,
+		&video.AudioCodec,
+		&video.Bitrate,
+		&video.FrameRate,
+		&video.Rotation,
+		&video.Width,
+		&video.Height,
+		&video.Visibility,
+		&video.UserID,
+	)
+	return video, err
+}
+
+func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
+	query := `
+	SELECT` + videoColumns + `
 	FROM videos
 	WHERE user_id = ?
 	ORDER BY created_at DESC
@@ -47,17 +260,8 @@ func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
 
 	videos := []Video{}
 	for rows.Next() {
-		var video Video
-		if err := rows.Scan(
-			&video.ID,
-			&video.CreatedAt,
-			&video.UpdatedAt,
-			&video.Title,
-			&video.Description,
-			&video.ThumbnailURL,
-			&video.VideoURL,
-			&video.UserID,
-		); err != nil {
+		video, err := scanVideo(rows)
+		if err != nil {
 			return nil, err
 		}
 		videos = append(videos, video)
@@ -67,6 +271,15 @@ func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
 }
 
 func (c Client) CreateVideo(params CreateVideoParams) (Video, error) {
+	return c.createVideo(params, nil)
+}
+
+// CreateDerivedVideo creates a video made from sourceID, such as a trim.
+func (c Client) CreateDerivedVideo(params CreateVideoParams, sourceID uuid.UUID) (Video, error) {
+	return c.createVideo(params, &sourceID)
+}
+
+func (c Client) createVideo(params CreateVideoParams, sourceID *uuid.UUID) (Video, error) {
 	id := uuid.New()
 	query := `
 	INSERT INTO videos (
@@ -75,10 +288,15 @@ func (c Client) CreateVideo(params CreateVideoParams) (Video, error) {
 		updated_at,
 		title,
 		description,
-		user_id
-	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?)
+		visibility,
+		user_id,
+		source_video_id
+	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?, ?, ?)
 	`
-	_, err := c.db.Exec(query, id, params.Title, params.Description, params.UserID)
+	if params.Visibility == "" {
+		params.Visibility = VisibilityPublic
+	}
+	_, err := c.db.Exec(query, id, params.Title, params.Description, params.Visibility, params.UserID, sourceID)
 	if err != nil {
 		return Video{}, err
 	}
@@ -88,29 +306,12 @@ func (c Client) CreateVideo(params CreateVideoParams) (Video, error) {
 
 func (c Client) GetVideo(id uuid.UUID) (Video, error) {
 	query := `
-	SELECT
-		id,
-		created_at,
-		updated_at,
-		title,
-		description,
-		thumbnail_url,
-		video_url,
-		user_id
+	SELECT` + videoColumns + `
 	FROM videos
 	WHERE id = ?
 	`
 
-	var video Video
-	err := c.db.QueryRow(query, id).Scan(
-		&video.ID,
-		&video.CreatedAt,
-		&video.UpdatedAt,
-		&video.Title,
-		&video.Description,
-		&video.ThumbnailURL,
-		&video.VideoURL,
-		&video.UserID)
+	video, err := scanVideo(c.db.QueryRow(query, id))
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return Video{}, nil
@@ -122,34 +323,326 @@ func (c Client) GetVideo(id uuid.UUID) (Video, error) {
 }
 
 func (c Client) UpdateVideo(video Video) error {
+	return updateVideo(c.db, video)
+}
+
+// UpdateVideoReplacingMedia updates the video and releases the objects it
+// no longer points to, atomically.
+func (c Client) UpdateVideoReplacingMedia(video Video, released []MediaRelease) error {
+	return c.inTx(func(tx *sql.Tx) error {
+		err := updateVideo(tx, video)
+		if err != nil {
+			return err
+		}
+		return releaseMedia(tx, released)
+	})
+}
+
+func updateVideo(db execer, video Video) error {
 	query := `
 	UPDATE videos
 	SET
 		title = ?,
 		description = ?,
 		thumbnail_url = ?,
+		thumbnail_variants = ?,
 		video_url = ?,
+		hls_url = ?,
+		thumbnail_track_url = ?,
+		sprite_sheets = ?,
+		preview_url = ?,
+		audio_url = ?,
+		waveform_url = ?,
+		thumbnail_checksum_sha256 = ?,
+		video_checksum_sha256 = ?,
+		processing_status = ?,
+		processing_error = ?,
+		original_key = ?,
+		watermark = ?,
+		visibility = ?,
 		user_id = ?
 	WHERE id = ?
 	`
 
-	_, err := c.db.Exec(
+	_, err := db.Exec(
 		query,
 		video.Title,
 		video.Description,
 		&video.ThumbnailURL,
+		video.ThumbnailVariants,
 		&video.VideoURL,
+		video.HLSURL,
+		video.ThumbnailTrackURL,
+		video.SpriteSheets,
+		video.PreviewURL,
+		video.AudioURL,
+		video.WaveformURL,
+		video.ThumbnailChecksumSHA256,
+		video.VideoChecksumSHA256,
+		video.ProcessingStatus,
+		video.ProcessingError,
+		video.OriginalKey,
+		video.Watermark,
+		video.Visibility,
 		video.UserID,
 		video.ID,
 	)
 	return err
 }
 
+func (c Client) GetAllVideos() ([]Video, error) {
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos
+	`
+
+	rows, err := c.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	videos := []Video{}
+	for rows.Next() {
+		video, err := scanVideo(rows)
+		if err != nil {
+			return nil, err
+		}
+		videos = append(videos, video)
+	}
+	return videos, rows.Err()
+}
+
+// GetVideosWithAbsoluteURLs returns every video that still has a full URL
+// rather than a storage key in one of its media columns.
+func (c Client) GetVideosWithAbsoluteURLs() ([]Video, error) {
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos
+	WHERE thumbnail_url LIKE '%://%'
+		OR video_url LIKE '%://%'
+		OR hls_url LIKE '%://%'
+	`
+
+	rows, err := c.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	videos := []Video{}
+	for rows.Next() {
+		video, err := scanVideo(rows)
+		if err != nil {
+			return nil, err
+		}
+		videos = append(videos, video)
+	}
+	return videos, rows.Err()
+}
+
+// SetVideoMedia only touches the media columns, so it can't clobber changes
+// made to the rest of the row in the meantime.
+func (c Client) SetVideoMedia(id uuid.UUID, thumbnailURL, videoURL, hlsURL *string) error {
+	query := `
+	UPDATE videos
+	SET
+		thumbnail_url = ?,
+		video_url = ?,
+		hls_url = ?
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, thumbnailURL, videoURL, hlsURL, id)
+	return err
+}
+
+// ErrVideoChanged is returned by the updates that only go ahead if a column
+// still holds the value the caller read, when another request changed it in
+// the meantime.
+var ErrVideoChanged = errors.New("video was changed by another request")
+
+// SetVideoThumbnail points the video at video's thumbnail and releases the
+// objects of the one it replaces, atomically, as long as the thumbnail is
+// still previous. Only the thumbnail columns are written, so a processing
+// job finishing meanwhile isn't undone.
+func (c Client) SetVideoThumbnail(video Video, previous *string, released []MediaRelease) error {
+	return c.inTx(func(tx *sql.Tx) error {
+		query := `
+		UPDATE videos
+		SET
+			thumbnail_url = ?,
+			thumbnail_variants = ?,
+			thumbnail_checksum_sha256 = ?
+		WHERE id = ? AND thumbnail_url IS ?
+		`
+		result, err := tx.Exec(query, video.ThumbnailURL, video.ThumbnailVariants, video.ThumbnailChecksumSHA256, video.ID, previous)
+		if err != nil {
+			return err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return ErrVideoChanged
+		}
+		return releaseMedia(tx, released)
+	})
+}
+
+// SetVideoHLSURL points the video at another HLS master playlist and
+// releases the objects it no longer needs, atomically, as long as hls_url is
+// still previous. Nothing but hls_url is written.
+func (c Client) SetVideoHLSURL(id uuid.UUID, previous, hlsURL *string, released []MediaRelease) error {
+	return c.inTx(func(tx *sql.Tx) error {
+		query := `
+		UPDATE videos
+		SET hls_url = ?
+		WHERE id = ? AND hls_url IS ?
+		`
+		result, err := tx.Exec(query, hlsURL, id, previous)
+		if err != nil {
+			return err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return ErrVideoChanged
+		}
+		return releaseMedia(tx, released)
+	})
+}
+
+func (c Client) SetVideoVisibility(id uuid.UUID, visibility Visibility) error {
+	query := `
+	UPDATE videos
+	SET visibility = ?
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, visibility, id)
+	return err
+}
+
+func (c Client) SetVideoProcessingStatus(id uuid.UUID, status ProcessingStatus, processingError *string) error {
+	query := `
+	UPDATE videos
+	SET
+		processing_status = ?,
+		processing_error = ?
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, status, processingError, id)
+	return err
+}
+
+// UpdateVideoMetadata is kept apart from UpdateVideo so that saving other
+// fields never clobbers the probe results.
+func (c Client) UpdateVideoMetadata(id uuid.UUID, metadata VideoMetadata) error {
+	query := `
+	UPDATE videos
+	SET
+		duration_seconds = ?,
+		container = ?,
+		video_codec = ?,
+		audio_codec = ?,
+		bitrate = ?,
+		frame_rate = ?,
+		rotation = ?,
+		width = ?,
+		height = ?
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(
+		query,
+		metadata.DurationSeconds,
+		metadata.Container,
+		metadata.VideoCodec,
+		metadata.AudioCodec,
+		metadata.Bitrate,
+		metadata.FrameRate,
+		metadata.Rotation,
+		metadata.Width,
+		metadata.Height,
+		id,
+	)
+	return err
+}
+
 func (c Client) DeleteVideo(id uuid.UUID) error {
+	return deleteVideo(c.db, id)
+}
+
+// DeleteVideoAndMedia deletes the video and releases its stored objects,
+// atomically. It returns the local files of the video's unfinished uploads
+// and queued processing jobs, which are the caller's to remove. The file of
+// a job that's being processed is removed by its worker.
+func (c Client) DeleteVideoAndMedia(id uuid.UUID, released []MediaRelease) ([]string, error) {
+	var files []string
+	err := c.inTx(func(tx *sql.Tx) error {
+		query := `
+		SELECT file_path FROM upload_sessions
+		WHERE video_id = ? AND completed_at IS NULL
+		UNION ALL
+		SELECT source_path FROM processing_jobs
+		WHERE video_id = ? AND status = ? AND source_path != ''
+		`
+		rows, err := tx.Query(query, id, id, JobStatusPending)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var file string
+			err = rows.Scan(&file)
+			if err != nil {
+				return err
+			}
+			files = append(files, file)
+		}
+		err = rows.Err()
+		if err != nil {
+			return err
+		}
+
+		err = deleteVideo(tx, id)
+		if err != nil {
+			return err
+		}
+		return releaseMedia(tx, released)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+func deleteVideo(db execer, id uuid.UUID) error {
+	// Videos made from this one stay, they just lose the link.
 	query := `
+	UPDATE videos
+	SET source_video_id = NULL
+	WHERE source_video_id = ?
+	`
+	_, err := db.Exec(query, id)
+	if err != nil {
+		return err
+	}
+
+	// Foreign keys aren't enforced, so the rows that would cascade are
+	// deleted here.
+	for _, table := range []string{"captions", "upload_sessions", "processing_jobs"} {
+		_, err = db.Exec("DELETE FROM "+table+" WHERE video_id = ?", id)
+		if err != nil {
+			return err
+		}
+	}
+
+	query = `
 	DELETE FROM videos
 	WHERE id = ?
 	`
-	_, err := c.db.Exec(query, id)
+	_, err = db.Exec(query, id)
 	return err
 }
@@ -0,0 +1,131 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Watermark is a user's own watermark, burned into their videos in place of
+// the global one. ImageURL holds a storage key in the database, like the
+// video's media.
+type Watermark struct {
+	UserID    uuid.UUID `json:"user_id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	ImageURL  string    `json:"image_url"`
+	// ImageSHA256 is the hex SHA-256 of the image.
+	ImageSHA256 string `json:"-"`
+	// Position is a corner such as "bottom-right", or "center".
+	Position string `json:"position"`
+	// Opacity is between 0 (invisible) and 1 (opaque).
+	Opacity float64 `json:"opacity"`
+}
+
+const watermarkColumns = `
+		user_id,
+		created_at,
+		updated_at,
+		image_key,
+		image_sha256,
+		position,
+		opacity`
+
+func scanWatermark(row rowScanner) (Watermark, error) {
+	var watermark Watermark
+	err := row.Scan(
+		&watermark.UserID,
+		&watermark.CreatedAt,
+		&watermark.UpdatedAt,
+		&watermark.ImageURL,
+		&watermark.ImageSHA256,
+		&watermark.Position,
+		&watermark.Opacity,
+	)
+	return watermark, err
+}
+
+// GetWatermark returns the user's watermark, or one with a zero UserID if
+// they haven't set one.
+func (c Client) GetWatermark(userID uuid.UUID) (Watermark, error) {
+	query := `
+	SELECT` + watermarkColumns + `
+	FROM watermarks
+	WHERE user_id = ?
+	`
+	watermark, err := scanWatermark(c.db.QueryRow(query, userID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Watermark{}, nil
+	}
+	return watermark, err
+}
+
+func (c Client) GetAllWatermarks() ([]Watermark, error) {
+	query := `
+	SELECT` + watermarkColumns + `
+	FROM watermarks
+	`
+	rows, err := c.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	watermarks := []Watermark{}
+	for rows.Next() {
+		watermark, err := scanWatermark(rows)
+		if err != nil {
+			return nil, err
+		}
+		watermarks = append(watermarks, watermark)
+	}
+	return watermarks, rows.Err()
+}
+
+// SetWatermarkReplacingMedia creates or replaces the user's watermark and
+// releases the image it no longer points at, atomically.
+func (c Client) SetWatermarkReplacingMedia(watermark Watermark, released []MediaRelease) (Watermark, error) {
+	var saved Watermark
+	err := c.inTx(func(tx *sql.Tx) error {
+		query := `
+		INSERT INTO watermarks (
+			user_id,
+			created_at,
+			updated_at,
+			image_key,
+			image_sha256,
+			position,
+			opacity
+		) VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (user_id) DO UPDATE SET
+			updated_at = excluded.updated_at,
+			image_key = excluded.image_key,
+			image_sha256 = excluded.image_sha256,
+			position = excluded.position,
+			opacity = excluded.opacity
+		RETURNING` + watermarkColumns
+
+		now := dbNow()
+		var err error
+		saved, err = scanWatermark(tx.QueryRow(query, watermark.UserID, now, now, watermark.ImageURL, watermark.ImageSHA256, watermark.Position, watermark.Opacity))
+		if err != nil {
+			return err
+		}
+		return releaseMedia(tx, released)
+	})
+	return saved, err
+}
+
+// DeleteWatermarkAndMedia deletes the user's watermark and releases its
+// image, atomically.
+func (c Client) DeleteWatermarkAndMedia(userID uuid.UUID, released []MediaRelease) error {
+	return c.inTx(func(tx *sql.Tx) error {
+		_, err := tx.Exec("DELETE FROM watermarks WHERE user_id = ?", userID)
+		if err != nil {
+			return err
+		}
+		return releaseMedia(tx, released)
+	})
+}
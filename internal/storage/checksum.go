@@ -0,0 +1,96 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+)
+
+// ErrChecksumMismatch is returned by Put when the stored bytes don't match
+// PutOptions.Checksum. Nothing is stored in that case.
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+type ChecksumAlgorithm string
+
+const (
+	ChecksumSHA256 ChecksumAlgorithm = "SHA256"
+	ChecksumCRC32C ChecksumAlgorithm = "CRC32C"
+)
+
+// Checksum is a digest of an object's full content in the form S3 uses: the
+// raw digest, base64 encoded. The zero value means no checksum.
+type Checksum struct {
+	Algorithm ChecksumAlgorithm
+	Value     string
+}
+
+// ParseChecksum validates a base64 encoded digest for algorithm.
+func ParseChecksum(algorithm ChecksumAlgorithm, value string) (Checksum, error) {
+	h, err := NewChecksumHash(algorithm)
+	if err != nil {
+		return Checksum{}, err
+	}
+	digest, err := base64.StdEncoding.DecodeString(value)
+	if err != nil || len(digest) != h.Size() {
+		return Checksum{}, fmt.Errorf("invalid %s checksum %q", algorithm, value)
+	}
+	return Checksum{Algorithm: algorithm, Value: value}, nil
+}
+
+// NewChecksumHash returns a hash computing checksums for algorithm.
+func NewChecksumHash(algorithm ChecksumAlgorithm) (hash.Hash, error) {
+	switch algorithm {
+	case ChecksumSHA256:
+		return sha256.New(), nil
+	case ChecksumCRC32C:
+		return crc32.New(crc32.MakeTable(crc32.Castagnoli)), nil
+	}
+	return nil, fmt.Errorf("unsupported checksum algorithm %q", algorithm)
+}
+
+// ChecksumOf wraps the digest computed by h.
+func ChecksumOf(algorithm ChecksumAlgorithm, h hash.Hash) Checksum {
+	return Checksum{Algorithm: algorithm, Value: base64.StdEncoding.EncodeToString(h.Sum(nil))}
+}
+
+func (c Checksum) IsZero() bool {
+	return c.Algorithm == ""
+}
+
+// checksumVerifier hashes what's written to it when a checksum is expected.
+type checksumVerifier struct {
+	expected Checksum
+	hash     hash.Hash
+}
+
+func newChecksumVerifier(expected Checksum) (*checksumVerifier, error) {
+	if expected.IsZero() {
+		return &checksumVerifier{}, nil
+	}
+	h, err := NewChecksumHash(expected.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	return &checksumVerifier{expected: expected, hash: h}, nil
+}
+
+func (v *checksumVerifier) Write(p []byte) (int, error) {
+	if v.hash == nil {
+		return len(p), nil
+	}
+	return v.hash.Write(p)
+}
+
+func (v *checksumVerifier) verify() error {
+	if v.hash == nil {
+		return nil
+	}
+	actual := ChecksumOf(v.expected.Algorithm, v.hash)
+	if actual.Value != v.expected.Value {
+		return fmt.Errorf("%w: expected %s %s, got %s", ErrChecksumMismatch, v.expected.Algorithm, v.expected.Value, actual.Value)
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Routed keeps the objects under one key prefix in a separate backend, such
+// as a private bucket next to the public one, and everything else in the
+// default backend. Keys are the same in both.
+type Routed struct {
+	fallback Storage
+	prefix   string
+	routed   Storage
+}
+
+// NewRouted sends keys starting with prefix to routed and the rest to
+// fallback. The result is a Presigner if both backends are.
+func NewRouted(fallback Storage, prefix string, routed Storage) Storage {
+	r := &Routed{fallback: fallback, prefix: prefix, routed: routed}
+	_, fallbackPresigns := fallback.(Presigner)
+	_, routedPresigns := routed.(Presigner)
+	if fallbackPresigns && routedPresigns {
+		return &presigningRouted{r}
+	}
+	return r
+}
+
+func (r *Routed) backend(key string) Storage {
+	if strings.HasPrefix(key, r.prefix) {
+		return r.routed
+	}
+	return r.fallback
+}
+
+func (r *Routed) Put(ctx context.Context, key string, body io.Reader, opts PutOptions) error {
+	return r.backend(key).Put(ctx, key, body, opts)
+}
+
+func (r *Routed) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	return r.backend(key).Get(ctx, key)
+}
+
+func (r *Routed) Delete(ctx context.Context, key string) error {
+	return r.backend(key).Delete(ctx, key)
+}
+
+func (r *Routed) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	return r.backend(key).Stat(ctx, key)
+}
+
+func (r *Routed) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	if strings.HasPrefix(prefix, r.prefix) {
+		return r.routed.List(ctx, prefix)
+	}
+	listed, err := r.fallback.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	objects := make([]ObjectInfo, 0, len(listed))
+	for _, object := range listed {
+		if !strings.HasPrefix(object.Key, r.prefix) {
+			objects = append(objects, object)
+		}
+	}
+	if !strings.HasPrefix(r.prefix, prefix) {
+		return objects, nil
+	}
+	routed, err := r.routed.List(ctx, r.prefix)
+	if err != nil {
+		return nil, err
+	}
+	objects = append(objects, routed...)
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
+
+func (r *Routed) URL(key string) string {
+	return r.backend(key).URL(key)
+}
+
+// presigningRouted is what NewRouted returns when both backends are
+// Presigners.
+type presigningRouted struct {
+	*Routed
+}
+
+func (r *presigningRouted) PresignPut(ctx context.Context, key, contentType string, size int64, checksum Checksum, ttl time.Duration) (string, map[string]string, error) {
+	return r.backend(key).(Presigner).PresignPut(ctx, key, contentType, size, checksum, ttl)
+}
+
+func (r *presigningRouted) PresignGet(ctx context.Context, key string, ttl time.Duration) (string, error) {
+	return r.backend(key).(Presigner).PresignGet(ctx, key, ttl)
+}
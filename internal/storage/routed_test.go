@@ -0,0 +1,64 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestRouted(t *testing.T) {
+	ctx := context.Background()
+	public := NewMemory("https://public.example.com")
+	private := NewMemory("https://private.example.com")
+	store := NewRouted(public, "originals/", private)
+
+	for _, key := range []string{"landscape/a.mp4", "originals/abc"} {
+		err := store.Put(ctx, key, strings.NewReader(key), PutOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := public.Stat(ctx, "originals/abc"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("original stored in the public backend: %v", err)
+	}
+	if _, err := private.Stat(ctx, "originals/abc"); err != nil {
+		t.Errorf("original not in the private backend: %v", err)
+	}
+	if _, err := private.Stat(ctx, "landscape/a.mp4"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("video stored in the private backend: %v", err)
+	}
+	if got := readObject(t, store, "originals/abc"); got != "originals/abc" {
+		t.Errorf("Get = %q", got)
+	}
+	if got := store.URL("originals/abc"); got != "https://private.example.com/originals/abc" {
+		t.Errorf("URL = %q", got)
+	}
+
+	objects, err := store.List(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 2 || objects[0].Key != "landscape/a.mp4" || objects[1].Key != "originals/abc" {
+		t.Errorf("List = %+v", objects)
+	}
+	objects, err = store.List(ctx, "originals/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 1 || objects[0].Key != "originals/abc" {
+		t.Errorf("List(originals/) = %+v", objects)
+	}
+
+	err = store.Delete(ctx, "originals/abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := private.Stat(ctx, "originals/abc"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("original still stored after Delete: %v", err)
+	}
+
+	if _, ok := store.(Presigner); ok {
+		t.Error("routing between memory backends claims to presign")
+	}
+}
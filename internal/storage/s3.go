@@ -0,0 +1,205 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+)
+
+type S3 struct {
+	client  *s3.Client
+	bucket  string
+	baseURL string
+	opts    S3Options
+}
+
+// NewS3 stores objects in bucket. baseURL is the public origin objects are
+// served from, usually the CloudFront distribution in front of the bucket.
+func NewS3(client *s3.Client, bucket, baseURL string, opts S3Options) *S3 {
+	return &S3{
+		client:  client,
+		bucket:  bucket,
+		baseURL: baseURL,
+		opts:    opts.withDefaults(),
+	}
+}
+
+func (s *S3) Put(ctx context.Context, key string, body io.Reader, opts PutOptions) error {
+	key, err := cleanKey(key)
+	if err != nil {
+		return err
+	}
+
+	// Anything larger than a single part goes through a multipart upload.
+	var buf bytes.Buffer
+	n, err := io.CopyN(&buf, body, s.opts.PartSize)
+	if err == nil {
+		first := buf.Bytes()[:n:n]
+		return s.putMultipart(ctx, key, first, body, opts)
+	}
+	if err != io.EOF {
+		return err
+	}
+
+	input := &s3.PutObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+		Body:   bytes.NewReader(buf.Bytes()),
+	}
+	if opts.ContentType != "" {
+		input.ContentType = aws.String(opts.ContentType)
+	}
+	switch opts.Checksum.Algorithm {
+	case "":
+	case ChecksumSHA256:
+		input.ChecksumSHA256 = aws.String(opts.Checksum.Value)
+	case ChecksumCRC32C:
+		input.ChecksumCRC32C = aws.String(opts.Checksum.Value)
+	default:
+		return fmt.Errorf("unsupported checksum algorithm %q", opts.Checksum.Algorithm)
+	}
+	_, err = s.client.PutObject(ctx, input)
+	return mapS3Error(err)
+}
+
+func (s *S3) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	key, err := cleanKey(key)
+	if err != nil {
+		return nil, err
+	}
+	out, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, mapS3Error(err)
+	}
+	return out.Body, nil
+}
+
+func (s *S3) Delete(ctx context.Context, key string) error {
+	key, err := cleanKey(key)
+	if err != nil {
+		return err
+	}
+	_, err = s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	return err
+}
+
+func (s *S3) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	key, err := cleanKey(key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	out, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return ObjectInfo{}, mapS3Error(err)
+	}
+	return ObjectInfo{
+		Key:          key,
+		Size:         aws.ToInt64(out.ContentLength),
+		ContentType:  aws.ToString(out.ContentType),
+		LastModified: aws.ToTime(out.LastModified),
+	}, nil
+}
+
+func (s *S3) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	objects := []ObjectInfo{}
+	paginator := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(prefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range page.Contents {
+			objects = append(objects, ObjectInfo{
+				Key:          aws.ToString(obj.Key),
+				Size:         aws.ToInt64(obj.Size),
+				LastModified: aws.ToTime(obj.LastModified),
+			})
+		}
+	}
+	return objects, nil
+}
+
+func (s *S3) URL(key string) string {
+	return joinURL(s.baseURL, key)
+}
+
+func mapS3Error(err error) error {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "NotFound", "NoSuchKey":
+			return ErrNotFound
+		case "BadDigest":
+			return fmt.Errorf("%w: %v", ErrChecksumMismatch, err)
+		}
+	}
+	return err
+}
+
+func (s *S3) PresignPut(ctx context.Context, key, contentType string, size int64, checksum Checksum, ttl time.Duration) (string, map[string]string, error) {
+	key, err := cleanKey(key)
+	if err != nil {
+		return "", nil, err
+	}
+	input := &s3.PutObjectInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(key),
+		ContentType: aws.String(contentType),
+		// Signed, so S3 rejects a body of any other length. Clients send
+		// Content-Length on their own, it isn't in the returned headers.
+		ContentLength: aws.Int64(size),
+	}
+	headers := map[string]string{"Content-Type": contentType}
+	switch checksum.Algorithm {
+	case "":
+	case ChecksumSHA256:
+		input.ChecksumSHA256 = aws.String(checksum.Value)
+		headers["x-amz-checksum-sha256"] = checksum.Value
+	case ChecksumCRC32C:
+		input.ChecksumCRC32C = aws.String(checksum.Value)
+		headers["x-amz-checksum-crc32c"] = checksum.Value
+	default:
+		return "", nil, fmt.Errorf("unsupported checksum algorithm %q", checksum.Algorithm)
+	}
+	presignClient := s3.NewPresignClient(s.client)
+	req, err := presignClient.PresignPutObject(ctx, input, s3.WithPresignExpires(ttl))
+	if err != nil {
+		return "", nil, err
+	}
+	return req.URL, headers, nil
+}
+
+func (s *S3) PresignGet(ctx context.Context, key string, ttl time.Duration) (string, error) {
+	key, err := cleanKey(key)
+	if err != nil {
+		return "", err
+	}
+	presignClient := s3.NewPresignClient(s.client)
+	req, err := presignClient.PresignGetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	}, s3.WithPresignExpires(ttl))
+	if err != nil {
+		return "", err
+	}
+	return req.URL, nil
+}
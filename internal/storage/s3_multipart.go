@@ -0,0 +1,263 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+const (
+	minPartSize  = 5 << 20 // S3 rejects smaller parts, except for the last one
+	maxPartCount = 10000
+)
+
+type S3Options struct {
+	// PartSize is the size of each multipart upload part. Objects smaller
+	// than one part are sent with a single PutObject.
+	PartSize int64
+	// Concurrency is how many parts are uploaded at the same time.
+	Concurrency int
+	// PartRetries is how many times a failed part is retried before the
+	// whole upload is aborted.
+	PartRetries int
+}
+
+func (o S3Options) withDefaults() S3Options {
+	if o.PartSize < minPartSize {
+		o.PartSize = minPartSize
+	}
+	if o.Concurrency < 1 {
+		o.Concurrency = 1
+	}
+	if o.PartRetries < 0 {
+		o.PartRetries = 0
+	}
+	return o
+}
+
+// putMultipart uploads an object in parts. With a checksum every part is
+// sent with its own checksum of the same algorithm, which S3 validates as
+// the parts arrive. S3 only keeps full-object checksums for CRC32C, so for
+// those it validates opts.Checksum itself; for SHA-256 we check the bytes we
+// read against it before completing the upload.
+func (s *S3) putMultipart(ctx context.Context, key string, first []byte, rest io.Reader, opts PutOptions) error {
+	input := &s3.CreateMultipartUploadInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	}
+	if opts.ContentType != "" {
+		input.ContentType = aws.String(opts.ContentType)
+	}
+	verifier, err := newChecksumVerifier(opts.Checksum)
+	if err != nil {
+		return err
+	}
+	if !opts.Checksum.IsZero() {
+		input.ChecksumAlgorithm = types.ChecksumAlgorithm(opts.Checksum.Algorithm)
+		if opts.Checksum.Algorithm == ChecksumCRC32C {
+			input.ChecksumType = types.ChecksumTypeFullObject
+		}
+	}
+	upload, err := s.client.CreateMultipartUpload(ctx, input)
+	if err != nil {
+		return err
+	}
+	uploadID := upload.UploadId
+
+	verifier.Write(first)
+	parts, err := s.uploadParts(ctx, key, uploadID, first, io.TeeReader(rest, verifier), opts.Checksum.Algorithm)
+	if err == nil {
+		err = verifier.verify()
+	}
+	if err != nil {
+		// Use a fresh context, ctx may be the reason we're bailing out.
+		abortCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		_, abortErr := s.client.AbortMultipartUpload(abortCtx, &s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(s.bucket),
+			Key:      aws.String(key),
+			UploadId: uploadID,
+		})
+		return errors.Join(err, abortErr)
+	}
+
+	complete := &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(s.bucket),
+		Key:             aws.String(key),
+		UploadId:        uploadID,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+	}
+	if opts.Checksum.Algorithm == ChecksumCRC32C {
+		complete.ChecksumCRC32C = aws.String(opts.Checksum.Value)
+		complete.ChecksumType = types.ChecksumTypeFullObject
+	}
+	_, err = s.client.CompleteMultipartUpload(ctx, complete)
+	return mapS3Error(err)
+}
+
+// uploadParts reads body one part at a time and uploads up to
+// opts.Concurrency parts in parallel. Memory use is bounded by
+// PartSize * Concurrency.
+func (s *S3) uploadParts(ctx context.Context, key string, uploadID *string, first []byte, rest io.Reader, algorithm ChecksumAlgorithm) ([]types.CompletedPart, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		parts    []types.CompletedPart
+		firstErr error
+	)
+	fail := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if firstErr == nil {
+			firstErr = err
+			cancel()
+		}
+	}
+
+	// first is already one of the Concurrency buffers.
+	buffers := make(chan []byte, s.opts.Concurrency)
+	for i := 1; i < s.opts.Concurrency; i++ {
+		buffers <- make([]byte, s.opts.PartSize)
+	}
+
+	data := first
+	for partNumber := int32(1); ; partNumber++ {
+		if partNumber > maxPartCount {
+			fail(fmt.Errorf("object needs more than %d parts, increase the part size", maxPartCount))
+			break
+		}
+
+		wg.Add(1)
+		go func(partNumber int32, data []byte) {
+			defer wg.Done()
+			part, err := s.uploadPartWithRetry(ctx, key, uploadID, partNumber, data, algorithm)
+			buffers <- data[:cap(data)]
+			if err != nil {
+				fail(fmt.Errorf("part %d: %w", partNumber, err))
+				return
+			}
+			mu.Lock()
+			parts = append(parts, part)
+			mu.Unlock()
+		}(partNumber, data)
+
+		var buf []byte
+		select {
+		case buf = <-buffers:
+		case <-ctx.Done():
+		}
+		if buf == nil {
+			break
+		}
+		n, err := io.ReadFull(rest, buf)
+		if n == 0 && (err == io.EOF || err == io.ErrUnexpectedEOF) {
+			buffers <- buf
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			fail(err)
+			break
+		}
+		data = buf[:n]
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(parts, func(i, j int) bool {
+		return *parts[i].PartNumber < *parts[j].PartNumber
+	})
+	return parts, nil
+}
+
+func (s *S3) uploadPartWithRetry(ctx context.Context, key string, uploadID *string, partNumber int32, data []byte, algorithm ChecksumAlgorithm) (types.CompletedPart, error) {
+	var err error
+	for attempt := 0; attempt <= s.opts.PartRetries; attempt++ {
+		if attempt > 0 {
+			backoff := time.Duration(1<<(attempt-1)) * 500 * time.Millisecond
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return types.CompletedPart{}, ctx.Err()
+			}
+		}
+
+		input := &s3.UploadPartInput{
+			Bucket:     aws.String(s.bucket),
+			Key:        aws.String(key),
+			UploadId:   uploadID,
+			PartNumber: aws.Int32(partNumber),
+			Body:       bytes.NewReader(data),
+		}
+		if algorithm != "" {
+			// The SDK computes the part's checksum for us.
+			input.ChecksumAlgorithm = types.ChecksumAlgorithm(algorithm)
+		}
+		var out *s3.UploadPartOutput
+		out, err = s.client.UploadPart(ctx, input)
+		if err == nil {
+			return types.CompletedPart{
+				ETag:           out.ETag,
+				PartNumber:     aws.Int32(partNumber),
+				ChecksumSHA256: out.ChecksumSHA256,
+				ChecksumCRC32C: out.ChecksumCRC32C,
+			}, nil
+		}
+		if ctx.Err() != nil {
+			return types.CompletedPart{}, ctx.Err()
+		}
+	}
+	return types.CompletedPart{}, err
+}
+
+// AbortStaleUploads aborts multipart uploads started more than olderThan ago.
+// Those are left behind when the process dies mid-upload, and S3 keeps
+// billing for their parts until they're aborted.
+func (s *S3) AbortStaleUploads(ctx context.Context, olderThan time.Duration) (int, error) {
+	cutoff := time.Now().Add(-olderThan)
+	aborted := 0
+	input := &s3.ListMultipartUploadsInput{
+		Bucket: aws.String(s.bucket),
+	}
+	for {
+		page, err := s.client.ListMultipartUploads(ctx, input)
+		if err != nil {
+			return aborted, err
+		}
+		for _, upload := range page.Uploads {
+			if upload.Initiated == nil || upload.Initiated.After(cutoff) {
+				continue
+			}
+			_, err := s.client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+				Bucket:   aws.String(s.bucket),
+				Key:      upload.Key,
+				UploadId: upload.UploadId,
+			})
+			if err != nil {
+				return aborted, err
+			}
+			aborted++
+		}
+		if !aws.ToBool(page.IsTruncated) {
+			return aborted, nil
+		}
+		input.KeyMarker = page.NextKeyMarker
+		input.UploadIdMarker = page.NextUploadIdMarker
+	}
+}
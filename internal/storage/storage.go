@@ -0,0 +1,63 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+)
+
+var ErrNotFound = errors.New("object not found")
+
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	ContentType  string
+	LastModified time.Time
+}
+
+type PutOptions struct {
+	ContentType string
+	// Checksum, if set, is verified by the backend against the bytes it
+	// receives. Put fails with ErrChecksumMismatch if they differ.
+	Checksum Checksum
+}
+
+// Storage is a flat key/value blob store. Keys are slash separated and
+// relative to the backend root, e.g. "landscape/abc123.mp4".
+type Storage interface {
+	Put(ctx context.Context, key string, body io.Reader, opts PutOptions) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+	Stat(ctx context.Context, key string) (ObjectInfo, error)
+	List(ctx context.Context, prefix string) ([]ObjectInfo, error)
+	URL(key string) string
+}
+
+// Presigner is implemented by backends that can hand clients a temporary URL
+// to upload or download an object directly, without the bytes passing
+// through us. A presigned upload with a checksum is only accepted if the
+// body matches it; the client has to send the headers PresignPut returns.
+// The upload must be exactly size bytes long.
+type Presigner interface {
+	PresignPut(ctx context.Context, key, contentType string, size int64, checksum Checksum, ttl time.Duration) (string, map[string]string, error)
+	PresignGet(ctx context.Context, key string, ttl time.Duration) (string, error)
+}
+
+func cleanKey(key string) (string, error) {
+	if key == "" || strings.HasPrefix(key, "/") {
+		return "", fmt.Errorf("invalid key %q", key)
+	}
+	cleaned := path.Clean(key)
+	if cleaned != key || cleaned == "." || strings.HasPrefix(cleaned, "../") || cleaned == ".." {
+		return "", fmt.Errorf("invalid key %q", key)
+	}
+	return cleaned, nil
+}
+
+func joinURL(baseURL, key string) string {
+	return strings.TrimSuffix(baseURL, "/") + "/" + key
+}
@@ -0,0 +1,158 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func sha256Checksum(t *testing.T, data string) Checksum {
+	t.Helper()
+	h := sha256.New()
+	io.WriteString(h, data)
+	return ChecksumOf(ChecksumSHA256, h)
+}
+
+func readObject(t *testing.T, store Storage, key string) string {
+	t.Helper()
+	body, err := store.Get(context.Background(), key)
+	if err != nil {
+		t.Fatalf("Get(%q): %v", key, err)
+	}
+	defer body.Close()
+	data, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// testBackend runs the behavior every Storage has to share.
+func testBackend(t *testing.T, store Storage) {
+	ctx := context.Background()
+
+	t.Run("put get stat delete", func(t *testing.T) {
+		key := "thumbnails/abc/image.png"
+		err := store.Put(ctx, key, strings.NewReader("hello"), PutOptions{ContentType: "image/png"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := readObject(t, store, key); got != "hello" {
+			t.Errorf("Get = %q, want %q", got, "hello")
+		}
+		info, err := store.Stat(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Key != key || info.Size != 5 || info.ContentType != "image/png" {
+			t.Errorf("Stat = %+v", info)
+		}
+
+		err = store.Put(ctx, key, strings.NewReader("replaced"), PutOptions{ContentType: "image/png"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := readObject(t, store, key); got != "replaced" {
+			t.Errorf("Get after overwrite = %q", got)
+		}
+
+		err = store.Delete(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.Stat(ctx, key); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Stat after Delete = %v, want ErrNotFound", err)
+		}
+		if _, err := store.Get(ctx, key); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Get after Delete = %v, want ErrNotFound", err)
+		}
+		if err := store.Delete(ctx, key); err != nil {
+			t.Errorf("deleting a missing object: %v", err)
+		}
+	})
+
+	t.Run("checksum", func(t *testing.T) {
+		key := "checksum/ok.txt"
+		err := store.Put(ctx, key, strings.NewReader("data"), PutOptions{Checksum: sha256Checksum(t, "data")})
+		if err != nil {
+			t.Fatalf("matching checksum: %v", err)
+		}
+		if got := readObject(t, store, key); got != "data" {
+			t.Errorf("Get = %q", got)
+		}
+
+		key = "checksum/bad.txt"
+		err = store.Put(ctx, key, strings.NewReader("data"), PutOptions{Checksum: sha256Checksum(t, "other")})
+		if !errors.Is(err, ErrChecksumMismatch) {
+			t.Fatalf("Put with wrong checksum = %v, want ErrChecksumMismatch", err)
+		}
+		if _, err := store.Stat(ctx, key); !errors.Is(err, ErrNotFound) {
+			t.Errorf("object stored despite checksum mismatch: %v", err)
+		}
+	})
+
+	t.Run("list", func(t *testing.T) {
+		for _, key := range []string{"list/a/1.txt", "list/a/2.txt", "list/b/1.txt"} {
+			err := store.Put(ctx, key, strings.NewReader(key), PutOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		objects, err := store.List(ctx, "list/a/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(objects) != 2 || objects[0].Key != "list/a/1.txt" || objects[1].Key != "list/a/2.txt" {
+			t.Errorf("List = %+v", objects)
+		}
+	})
+
+	t.Run("invalid keys", func(t *testing.T) {
+		for _, key := range []string{"", "/abs", "../escape", "a/../../b", "./a/b", "a//b"} {
+			if err := store.Put(ctx, key, strings.NewReader("x"), PutOptions{}); err == nil {
+				t.Errorf("Put(%q) succeeded", key)
+			}
+			if _, err := store.Get(ctx, key); err == nil || errors.Is(err, ErrNotFound) {
+				t.Errorf("Get(%q) = %v, want an invalid key error", key, err)
+			}
+			if _, err := store.Stat(ctx, key); err == nil || errors.Is(err, ErrNotFound) {
+				t.Errorf("Stat(%q) = %v, want an invalid key error", key, err)
+			}
+			if err := store.Delete(ctx, key); err == nil {
+				t.Errorf("Delete(%q) succeeded", key)
+			}
+		}
+	})
+
+	if got, want := store.URL("a/b.png"), "http://localhost:8091/assets/a/b.png"; got != want {
+		t.Errorf("URL = %q, want %q", got, want)
+	}
+}
+
+func TestMemory(t *testing.T) {
+	testBackend(t, NewMemory("http://localhost:8091/assets"))
+}
+
+func TestLocal(t *testing.T) {
+	store, err := NewLocal(t.TempDir(), "http://localhost:8091/assets/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testBackend(t, store)
+}
+
+func TestParseChecksum(t *testing.T) {
+	valid := sha256Checksum(t, "data").Value
+	if _, err := ParseChecksum(ChecksumSHA256, valid); err != nil {
+		t.Errorf("valid checksum rejected: %v", err)
+	}
+	if _, err := ParseChecksum(ChecksumSHA256, "AAAA"); err == nil {
+		t.Error("short checksum accepted")
+	}
+	if _, err := ParseChecksum("MD5", valid); err == nil {
+		t.Error("unknown algorithm accepted")
+	}
+}
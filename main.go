@@ -2,29 +2,61 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/cdnsign"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
 
 	"github.com/joho/godotenv"
 	_ "github.com/lib/pq"
 )
 
 type apiConfig struct {
-	db               database.Client
-	jwtSecret        string
-	platform         string
-	filepathRoot     string
-	assetsRoot       string
-	s3Client         *s3.Client
-	s3Bucket         string
-	s3Region         string
-	s3CfDistribution string
-	port             string
+	db                  database.Client
+	jwtSecret           string
+	platform            string
+	filepathRoot        string
+	assetsRoot          string
+	uploadsRoot         string
+	uploadLocks         *uploadLocks
+	uploadLimits        *uploadLimiter
+	uploadSessionTTL    time.Duration
+	processing          *processingQueue
+	storageCleanup      *storageCleanup
+	events              *videoEventBus
+	hlsEnabled          bool
+	spriteInterval      time.Duration
+	previewStart        time.Duration
+	previewDuration     time.Duration
+	previewSegments     int
+	audioFormat         string
+	waveformRate        int
+	watermark           *watermarkSettings
+	originalsPrivate    bool
+	thumbnailMode       string
+	thumbnailTimestamp  time.Duration
+	allowedVideoFormats []string
+	allowedVideoCodecs  []string
+	allowedAudioCodecs  []string
+	storage             storage.Storage
+	storageBackend      string
+	urlSigner           *cdnsign.Signer
+	signedURLTTL        time.Duration
+	deliveryMode        string
+	presignedURLTTL     time.Duration
+	s3Bucket            string
+	s3Region            string
+	s3CfDistribution    string
+	port                string
 }
 
 type thumbnail struct {
@@ -65,44 +97,200 @@ func main() {
 		log.Fatal("ASSETS_ROOT environment variable is not set")
 	}
 
-	s3Config, err := config.LoadDefaultConfig(context.Background(), config.WithRegion(os.Getenv("S3_REGION")))
-	if err != nil {
-		log.Fatal("s3Config failed to load")
+	uploadsRoot := os.Getenv("UPLOADS_ROOT")
+	if uploadsRoot == "" {
+		uploadsRoot = "./uploads"
+	}
+
+	port := os.Getenv("PORT")
+	if port == "" {
+		log.Fatal("PORT environment variable is not set")
+	}
+
+	storageBackend := os.Getenv("STORAGE_BACKEND")
+	if storageBackend == "" {
+		storageBackend = "s3"
+	}
+
+	deliveryMode := os.Getenv("VIDEO_DELIVERY")
+	if deliveryMode == "" {
+		deliveryMode = deliveryModeCDN
+	}
+	if deliveryMode != deliveryModeCDN && deliveryMode != deliveryModePresigned {
+		log.Fatalf("Unknown VIDEO_DELIVERY %q (expected cdn or presigned)", deliveryMode)
 	}
 
-	s3Client := s3.NewFromConfig(s3Config)
+	var s3Bucket, s3Region, s3CfDistribution string
+	var store storage.Storage
+	// The local and memory backends are only served through /assets/, which
+	// hides originals.
+	originalsPrivate := storageBackend != "s3"
+	switch storageBackend {
+	case "s3":
+		s3Bucket = os.Getenv("S3_BUCKET")
+		if s3Bucket == "" {
+			log.Fatal("S3_BUCKET environment variable is not set")
+		}
+
+		s3Region = os.Getenv("S3_REGION")
+		if s3Region == "" {
+			log.Fatal("S3_REGION environment variable is not set")
+		}
 
-	s3Bucket := os.Getenv("S3_BUCKET")
-	if s3Bucket == "" {
-		log.Fatal("S3_BUCKET environment variable is not set")
+		// Presigned delivery talks to the bucket directly, a distribution is
+		// only needed to serve through the CDN.
+		baseURL := fmt.Sprintf("https://%s.s3.%s.amazonaws.com", s3Bucket, s3Region)
+		s3CfDistribution = os.Getenv("S3_CF_DISTRO")
+		if s3CfDistribution != "" {
+			baseURL = "https://" + s3CfDistribution
+		} else if deliveryMode == deliveryModeCDN {
+			log.Fatal("S3_CF_DISTRO environment variable is not set (or use VIDEO_DELIVERY=presigned)")
+		}
+
+		s3Config, err := config.LoadDefaultConfig(context.Background(), config.WithRegion(s3Region))
+		if err != nil {
+			log.Fatal("s3Config failed to load")
+		}
+		s3Client := s3.NewFromConfig(s3Config)
+		s3Options := storage.S3Options{
+			PartSize:    int64(envInt("S3_PART_SIZE_MB", 16)) << 20,
+			Concurrency: envInt("S3_UPLOAD_CONCURRENCY", 4),
+			PartRetries: envInt("S3_PART_RETRIES", 3),
+		}
+		s3Stores := []*storage.S3{storage.NewS3(s3Client, s3Bucket, baseURL, s3Options)}
+		store = s3Stores[0]
+		// Kept originals and unprocessed direct uploads must never be
+		// served, so they go to a bucket of their own that nothing points at.
+		if originalsBucket := os.Getenv("ORIGINALS_BUCKET"); originalsBucket != "" {
+			originalsURL := fmt.Sprintf("https://%s.s3.%s.amazonaws.com", originalsBucket, s3Region)
+			s3Stores = append(s3Stores, storage.NewS3(s3Client, originalsBucket, originalsURL, s3Options))
+			store = storage.NewRouted(store, originalKeyPrefix, s3Stores[1])
+			store = storage.NewRouted(store, incomingKeyPrefix, s3Stores[1])
+			originalsPrivate = true
+		}
+		go func() {
+			for _, s3Store := range s3Stores {
+				aborted, err := s3Store.AbortStaleUploads(context.Background(), 24*time.Hour)
+				if err != nil {
+					log.Printf("Couldn't clean up stale multipart uploads: %v", err)
+					continue
+				}
+				if aborted > 0 {
+					log.Printf("Aborted %d stale multipart uploads", aborted)
+				}
+			}
+		}()
+	case "local":
+		localStore, err := storage.NewLocal(assetsRoot, fmt.Sprintf("http://localhost:%s/assets", port))
+		if err != nil {
+			log.Fatalf("Couldn't create local storage: %v", err)
+		}
+		store = localStore
+	case "memory":
+		store = storage.NewMemory(fmt.Sprintf("http://localhost:%s/assets", port))
+	default:
+		log.Fatalf("Unknown STORAGE_BACKEND %q (expected s3, local or memory)", storageBackend)
+	}
+	if _, ok := store.(storage.Presigner); deliveryMode == deliveryModePresigned && !ok {
+		log.Fatalf("VIDEO_DELIVERY=presigned needs a storage backend that can presign URLs, %s can't", storageBackend)
 	}
 
-	s3Region := os.Getenv("S3_REGION")
-	if s3Region == "" {
-		log.Fatal("S3_REGION environment variable is not set")
+	thumbnailMode := os.Getenv("THUMBNAIL_MODE")
+	if thumbnailMode == "" {
+		thumbnailMode = thumbnailModeTimestamp
+	}
+	if thumbnailMode != thumbnailModeTimestamp && thumbnailMode != thumbnailModeScene {
+		log.Fatalf("Unknown THUMBNAIL_MODE %q (expected timestamp or scene)", thumbnailMode)
 	}
 
-	s3CfDistribution := os.Getenv("S3_CF_DISTRO")
-	if s3CfDistribution == "" {
-		log.Fatal("S3_CF_DISTRO environment variable is not set")
+	// Unlisted and private videos are served through signed CloudFront URLs,
+	// which needs the key pair the distribution trusts.
+	var urlSigner *cdnsign.Signer
+	cloudfrontKeyPairID := os.Getenv("CLOUDFRONT_KEY_PAIR_ID")
+	cloudfrontPrivateKeyPath := os.Getenv("CLOUDFRONT_PRIVATE_KEY_PATH")
+	if cloudfrontKeyPairID != "" || cloudfrontPrivateKeyPath != "" {
+		urlSigner, err = cdnsign.LoadSigner(cloudfrontKeyPairID, cloudfrontPrivateKeyPath)
+		if err != nil {
+			log.Fatalf("Couldn't load CloudFront signing key: %v", err)
+		}
 	}
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		log.Fatal("PORT environment variable is not set")
+	audioFormat := os.Getenv("AUDIO_FORMAT")
+	if audioFormat == "" {
+		audioFormat = audioFormatM4A
+	}
+	if audioFormat != audioFormatM4A && audioFormat != audioFormatMP3 && audioFormat != audioFormatNone {
+		log.Fatalf("Unknown AUDIO_FORMAT %q (expected m4a, mp3 or none)", audioFormat)
+	}
+
+	// Without an image there's no global watermark, only the ones users set
+	// for themselves.
+	var watermark *watermarkSettings
+	if watermarkImage := os.Getenv("WATERMARK_IMAGE"); watermarkImage != "" {
+		position := os.Getenv("WATERMARK_POSITION")
+		if position == "" {
+			position = watermarkBottomRight
+		}
+		watermark, err = loadGlobalWatermark(watermarkImage, position, envFloat("WATERMARK_OPACITY", defaultWatermarkOpacity))
+		if err != nil {
+			log.Fatalf("Couldn't load WATERMARK_IMAGE: %v", err)
+		}
+	}
+	// Watermarked videos keep their original, which may only go where it
+	// can't be downloaded.
+	if !originalsPrivate {
+		userWatermarks, err := db.GetAllWatermarks()
+		if err != nil {
+			log.Fatalf("Couldn't load watermarks: %v", err)
+		}
+		if watermark != nil || len(userWatermarks) > 0 {
+			log.Fatal("Watermarks need ORIGINALS_BUCKET, a private bucket to keep originals in")
+		}
+	}
+
+	allowedVideoFormats := envList("ALLOWED_VIDEO_FORMATS", []string{"mp4", "mov", "webm", "mkv"})
+	for _, name := range allowedVideoFormats {
+		if _, ok := videoFormatByName(name); !ok {
+			log.Fatalf("Unknown format %q in ALLOWED_VIDEO_FORMATS (expected mp4, mov, webm or mkv)", name)
+		}
 	}
 
 	cfg := apiConfig{
-		db:               db,
-		jwtSecret:        jwtSecret,
-		platform:         platform,
-		filepathRoot:     filepathRoot,
-		assetsRoot:       assetsRoot,
-		s3Client:         s3Client,
-		s3Bucket:         s3Bucket,
-		s3Region:         s3Region,
-		s3CfDistribution: s3CfDistribution,
-		port:             port,
+		db:                  db,
+		jwtSecret:           jwtSecret,
+		platform:            platform,
+		filepathRoot:        filepathRoot,
+		assetsRoot:          assetsRoot,
+		uploadsRoot:         uploadsRoot,
+		uploadLocks:         newUploadLocks(),
+		uploadSessionTTL:    envDuration("UPLOAD_SESSION_TTL", 24*time.Hour),
+		processing:          newProcessingQueue(envInt("PROCESSING_WORKERS", 2), envInt("PROCESSING_MAX_ATTEMPTS", 5)),
+		storageCleanup:      newStorageCleanup(),
+		events:              newVideoEventBus(),
+		hlsEnabled:          envBool("HLS_ENABLED", true),
+		spriteInterval:      envDuration("SPRITE_INTERVAL", 10*time.Second),
+		previewStart:        envDuration("PREVIEW_START", time.Second),
+		previewDuration:     envDuration("PREVIEW_DURATION", 3*time.Second),
+		previewSegments:     envInt("PREVIEW_SEGMENTS", 1),
+		audioFormat:         audioFormat,
+		waveformRate:        envInt("WAVEFORM_PEAKS_PER_SECOND", 10),
+		watermark:           watermark,
+		originalsPrivate:    originalsPrivate,
+		thumbnailMode:       thumbnailMode,
+		thumbnailTimestamp:  envDuration("THUMBNAIL_TIMESTAMP", time.Second),
+		allowedVideoFormats: allowedVideoFormats,
+		allowedVideoCodecs:  envList("ALLOWED_VIDEO_CODECS", []string{"h264", "hevc", "av1", "vp9", "vp8", "mpeg4"}),
+		allowedAudioCodecs:  envList("ALLOWED_AUDIO_CODECS", []string{"aac", "mp3", "ac3", "eac3", "opus", "vorbis", "alac", "flac"}),
+		storage:             store,
+		storageBackend:      storageBackend,
+		urlSigner:           urlSigner,
+		signedURLTTL:        envDuration("SIGNED_URL_TTL", time.Hour),
+		deliveryMode:        deliveryMode,
+		presignedURLTTL:     envDuration("PRESIGNED_URL_TTL", time.Hour),
+		s3Bucket:            s3Bucket,
+		s3Region:            s3Region,
+		s3CfDistribution:    s3CfDistribution,
+		port:                port,
 	}
 
 	err = cfg.ensureAssetsDir()
@@ -110,12 +298,75 @@ func main() {
 		log.Fatalf("Couldn't create assets directory: %v", err)
 	}
 
+	err = cfg.ensureUploadsDir()
+	if err != nil {
+		log.Fatalf("Couldn't create uploads directory: %v", err)
+	}
+	removed, err := removeStrayUploads(db, uploadsRoot)
+	if err != nil {
+		log.Fatalf("Couldn't clean up uploads directory: %v", err)
+	}
+	if removed > 0 {
+		log.Printf("Removed %d leftover files from the uploads directory", removed)
+	}
+	// Queued videos and unfinished resumable uploads from before a restart
+	// count against the disk budget too.
+	uploadsUsage, err := uploadsDiskUsage(uploadsRoot)
+	if err != nil {
+		log.Fatalf("Couldn't measure uploads directory: %v", err)
+	}
+	cfg.uploadLimits = newUploadLimiter(envInt("MAX_CONCURRENT_UPLOADS", 16), int64(envInt("UPLOADS_MAX_DISK_MB", 20480))<<20, uploadsUsage)
+
+	err = cfg.migrateMediaKeys(context.Background())
+	if err != nil {
+		log.Fatalf("Couldn't migrate media URLs to storage keys: %v", err)
+	}
+
+	gcDefaults := gcOptions{
+		gracePeriod: envDuration("GC_GRACE_PERIOD", 24*time.Hour),
+		mode:        os.Getenv("GC_MODE"),
+	}
+	if gcDefaults.mode == "" {
+		gcDefaults.mode = gcModeQuarantine
+	}
+	if gcDefaults.mode != gcModeDelete && gcDefaults.mode != gcModeQuarantine {
+		log.Fatalf("Unknown GC_MODE %q (expected delete or quarantine)", gcDefaults.mode)
+	}
+	if len(os.Args) > 1 && os.Args[1] == "gc" {
+		err = cfg.runGCCommand(os.Args[2:], gcDefaults, os.Stdout)
+		if err != nil {
+			log.Fatalf("Garbage collection failed: %v", err)
+		}
+		return
+	}
+
+	cfg.startStorageCleanup(context.Background())
+	cfg.startUploadSessionSweep(context.Background())
+	if gcInterval := envDuration("GC_INTERVAL", 24*time.Hour); gcInterval > 0 {
+		cfg.startGarbageCollection(context.Background(), gcInterval, gcDefaults)
+	}
+
+	// The global watermark may have changed since the last start.
+	if queued := cfg.requeueForWatermark(nil); queued > 0 {
+		log.Printf("Queued %d videos to get their watermark updated", queued)
+	}
+
+	err = cfg.startProcessingWorkers(context.Background())
+	if err != nil {
+		log.Fatalf("Couldn't start processing workers: %v", err)
+	}
+
 	mux := http.NewServeMux()
 	appHandler := http.StripPrefix("/app", http.FileServer(http.Dir(filepathRoot)))
 	mux.Handle("/app/", appHandler)
 
-	assetsHandler := http.StripPrefix("/assets", http.FileServer(http.Dir(assetsRoot)))
+	var assetsHandler http.Handler = http.StripPrefix("/assets", http.FileServer(http.Dir(assetsRoot)))
+	if storageBackend == "memory" {
+		assetsHandler = http.StripPrefix("/assets/", storageHandler(store))
+	}
 	mux.Handle("/assets/", noCacheMiddleware(assetsHandler))
+	// Kept originals are for reprocessing only, they're never served.
+	mux.Handle("/assets/"+originalKeyPrefix, http.NotFoundHandler())
 
 	mux.HandleFunc("POST /api/login", cfg.handlerLogin)
 	mux.HandleFunc("POST /api/refresh", cfg.handlerRefresh)
@@ -124,11 +375,29 @@ func main() {
 	mux.HandleFunc("POST /api/users", cfg.handlerUsersCreate)
 
 	mux.HandleFunc("POST /api/videos", cfg.handlerVideoMetaCreate)
-	mux.HandleFunc("POST /api/thumbnail_upload/{videoID}", cfg.handlerUploadThumbnail)
-	mux.HandleFunc("POST /api/video_upload/{videoID}", cfg.handlerUploadVideo)
+	mux.HandleFunc("POST /api/thumbnail_upload/{videoID}", cfg.limitUploads(cfg.handlerUploadThumbnail))
+	mux.HandleFunc("POST /api/videos/{videoID}/thumbnail/generate", cfg.limitUploads(cfg.handlerThumbnailGenerate))
+	mux.HandleFunc("POST /api/video_upload/{videoID}", cfg.limitUploads(cfg.handlerUploadVideo))
+	mux.HandleFunc("POST /api/video_upload/{videoID}/presign", cfg.handlerUploadVideoPresign)
+	mux.HandleFunc("POST /api/video_upload/{videoID}/complete", cfg.limitUploads(cfg.handlerUploadVideoComplete))
+	mux.HandleFunc("POST /api/video_upload/{videoID}/sessions", cfg.handlerUploadSessionCreate)
+	mux.HandleFunc("HEAD /api/upload_sessions/{uploadID}", cfg.handlerUploadSessionHead)
+	mux.HandleFunc("PATCH /api/upload_sessions/{uploadID}", cfg.limitUploads(cfg.handlerUploadSessionPatch))
+	mux.HandleFunc("DELETE /api/upload_sessions/{uploadID}", cfg.handlerUploadSessionDelete)
 	mux.HandleFunc("GET /api/videos", cfg.handlerVideosRetrieve)
 	mux.HandleFunc("GET /api/videos/{videoID}", cfg.handlerVideoGet)
+	mux.HandleFunc("GET /api/videos/{videoID}/processing", cfg.handlerVideoProcessingGet)
+	mux.HandleFunc("GET /api/videos/{videoID}/events", cfg.handlerVideoEvents)
+	mux.HandleFunc("PUT /api/videos/{videoID}/visibility", cfg.handlerVideoVisibilitySet)
+	mux.HandleFunc("POST /api/videos/{videoID}/trim", cfg.limitUploads(cfg.handlerVideoTrim))
+	mux.HandleFunc("GET /api/videos/{videoID}/captions", cfg.handlerCaptionsList)
+	mux.HandleFunc("POST /api/videos/{videoID}/captions", cfg.handlerCaptionCreate)
+	mux.HandleFunc("PUT /api/videos/{videoID}/captions/{captionID}", cfg.handlerCaptionReplace)
+	mux.HandleFunc("DELETE /api/videos/{videoID}/captions/{captionID}", cfg.handlerCaptionDelete)
 	mux.HandleFunc("DELETE /api/videos/{videoID}", cfg.handlerVideoMetaDelete)
+	mux.HandleFunc("GET /api/watermark", cfg.handlerWatermarkGet)
+	mux.HandleFunc("PUT /api/watermark", cfg.handlerWatermarkSet)
+	mux.HandleFunc("DELETE /api/watermark", cfg.handlerWatermarkDelete)
 
 	mux.HandleFunc("POST /admin/reset", cfg.handlerReset)
 
@@ -140,3 +409,73 @@ func main() {
 	log.Printf("Serving on: http://localhost:%s/app/\n", port)
 	log.Fatal(srv.ListenAndServe())
 }
+
+// envBool reads an optional boolean setting, falling back when it's unset.
+func envBool(key string, fallback bool) bool {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Fatalf("%s must be true or false: %v", key, err)
+	}
+	return b
+}
+
+// envDuration reads an optional duration such as "90s" or "15m", falling
+// back when it's unset.
+func envDuration(key string, fallback time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Fatalf("%s must be a duration like 90s or 15m: %v", key, err)
+	}
+	return d
+}
+
+// envList reads an optional comma separated list, falling back when it's
+// unset.
+func envList(key string, fallback []string) []string {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	list := []string{}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// envFloat reads an optional number setting, falling back when it's unset.
+func envFloat(key string, fallback float64) float64 {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		log.Fatalf("%s must be a number: %v", key, err)
+	}
+	return f
+}
+
+// envInt reads an optional integer setting, falling back when it's unset.
+func envInt(key string, fallback int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Fatalf("%s must be an integer: %v", key, err)
+	}
+	return n
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+)
+
+// Clients can send one of these with an upload, holding the base64 digest
+// of the file like S3's x-amz-checksum-* headers. The upload is rejected if
+// what we received doesn't match.
+const (
+	checksumSHA256Header = "X-Checksum-SHA256"
+	checksumCRC32CHeader = "X-Checksum-CRC32C"
+)
+
+// uploadChecksum returns the checksum the client sent, or the zero Checksum
+// if it didn't send one.
+func uploadChecksum(header http.Header) (storage.Checksum, error) {
+	sha := header.Get(checksumSHA256Header)
+	crc := header.Get(checksumCRC32CHeader)
+	switch {
+	case sha != "" && crc != "":
+		return storage.Checksum{}, fmt.Errorf("send either %s or %s, not both", checksumSHA256Header, checksumCRC32CHeader)
+	case sha != "":
+		return storage.ParseChecksum(storage.ChecksumSHA256, sha)
+	case crc != "":
+		return storage.ParseChecksum(storage.ChecksumCRC32C, crc)
+	}
+	return storage.Checksum{}, nil
+}
+
+// hashingWriter hashes everything written through it, so uploads can be
+// hashed while they're copied to disk instead of being read twice. If the
+// client sent a checksum in another algorithm that's computed as well.
+type hashingWriter struct {
+	io.Writer
+	hash     hash.Hash
+	expected storage.Checksum
+	checksum hash.Hash
+}
+
+func newHashingWriter(w io.Writer, expected storage.Checksum) (*hashingWriter, error) {
+	h := sha256.New()
+	hw := &hashingWriter{hash: h, expected: expected, checksum: h}
+	if !expected.IsZero() && expected.Algorithm != storage.ChecksumSHA256 {
+		checksum, err := storage.NewChecksumHash(expected.Algorithm)
+		if err != nil {
+			return nil, err
+		}
+		hw.checksum = checksum
+		hw.Writer = io.MultiWriter(w, h, checksum)
+		return hw, nil
+	}
+	hw.Writer = io.MultiWriter(w, h)
+	return hw, nil
+}
+
+// sum is the hex SHA-256 blobs are keyed by.
+func (w *hashingWriter) sum() string {
+	return hex.EncodeToString(w.hash.Sum(nil))
+}
+
+func (w *hashingWriter) checksumSHA256() storage.Checksum {
+	return storage.ChecksumOf(storage.ChecksumSHA256, w.hash)
+}
+
+// verify checks what was written against the client's checksum. The error
+// wraps storage.ErrChecksumMismatch.
+func (w *hashingWriter) verify() error {
+	if w.expected.IsZero() {
+		return nil
+	}
+	actual := storage.ChecksumOf(w.expected.Algorithm, w.checksum)
+	if actual != w.expected {
+		return fmt.Errorf("%w: the upload's %s is %s, not %s", storage.ErrChecksumMismatch, w.expected.Algorithm, actual.Value, w.expected.Value)
+	}
+	return nil
+}
+
+func hashFile(filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	_, err = io.Copy(h, file)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// sha256Checksum turns a hex SHA-256 as returned by hashFile into the form
+// storage backends take.
+func sha256Checksum(sum string) (storage.Checksum, error) {
+	digest, err := hex.DecodeString(sum)
+	if err != nil {
+		return storage.Checksum{}, err
+	}
+	return storage.Checksum{
+		Algorithm: storage.ChecksumSHA256,
+		Value:     base64.StdEncoding.EncodeToString(digest),
+	}, nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+)
+
+const migrationMediaKeys = "media_urls_to_keys"
+
+// migrateMediaKeys rewrites videos saved when the media columns held full
+// URLs ("https://{distribution}/{key}", or "http://localhost:{port}/assets/
+// {key}" for thumbnails) so they hold storage keys like newer rows. It only
+// runs once per database.
+func (cfg *apiConfig) migrateMediaKeys(ctx context.Context) error {
+	applied, err := cfg.db.DataMigrationApplied(migrationMediaKeys)
+	if err != nil {
+		return err
+	}
+	if applied {
+		return nil
+	}
+
+	videos, err := cfg.db.GetVideosWithAbsoluteURLs()
+	if err != nil {
+		return err
+	}
+	for _, video := range videos {
+		thumbnailKey, err := cfg.legacyMediaKey(ctx, video.ThumbnailURL)
+		if err != nil {
+			return fmt.Errorf("video %s: %w", video.ID, err)
+		}
+		videoKey, err := cfg.legacyMediaKey(ctx, video.VideoURL)
+		if err != nil {
+			return fmt.Errorf("video %s: %w", video.ID, err)
+		}
+		hlsKey, err := cfg.legacyMediaKey(ctx, video.HLSURL)
+		if err != nil {
+			return fmt.Errorf("video %s: %w", video.ID, err)
+		}
+		err = cfg.db.SetVideoMedia(video.ID, thumbnailKey, videoKey, hlsKey)
+		if err != nil {
+			return fmt.Errorf("video %s: %w", video.ID, err)
+		}
+	}
+
+	err = cfg.db.MarkDataMigrationApplied(migrationMediaKeys)
+	if err != nil {
+		return err
+	}
+	if len(videos) > 0 {
+		log.Printf("Rewrote media URLs of %d videos as storage keys", len(videos))
+	}
+	return nil
+}
+
+// legacyMediaKey works out the storage key an old absolute URL pointed at.
+// Thumbnails used to be written to assetsRoot whatever the video backend
+// was; if the key isn't in storage but the file is still on disk, it's
+// copied over so the key resolves. Values that aren't URLs are left alone.
+func (cfg *apiConfig) legacyMediaKey(ctx context.Context, stored *string) (*string, error) {
+	if stored == nil || !strings.Contains(*stored, "://") {
+		return stored, nil
+	}
+	parsed, err := url.Parse(*stored)
+	if err != nil {
+		log.Printf("Leaving unparseable media URL %q as it is", *stored)
+		return stored, nil
+	}
+
+	localAsset := false
+	key := strings.TrimPrefix(parsed.Path, "/")
+	if strings.HasPrefix(*stored, cfg.storage.URL("")) {
+		key = strings.TrimPrefix(*stored, cfg.storage.URL(""))
+	} else if parsed.Hostname() == "localhost" && strings.HasPrefix(key, "assets/") {
+		key = strings.TrimPrefix(key, "assets/")
+		localAsset = true
+	}
+	if key == "" {
+		log.Printf("Leaving media URL %q without a key as it is", *stored)
+		return stored, nil
+	}
+
+	if localAsset {
+		_, err := cfg.storage.Stat(ctx, key)
+		if errors.Is(err, storage.ErrNotFound) {
+			assetPath := filepath.Join(cfg.assetsRoot, filepath.FromSlash(key))
+			if _, statErr := os.Stat(assetPath); statErr == nil {
+				err = cfg.putFile(ctx, assetPath, key, contentTypeForFile(key))
+			} else {
+				log.Printf("Asset %s behind %q is gone, keeping the key anyway", key, *stored)
+				err = nil
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &key, nil
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	processingPollInterval = 5 * time.Second
+	processingBaseBackoff  = 30 * time.Second
+	processingMaxBackoff   = 30 * time.Minute
+)
+
+// processingQueue runs video processing jobs stored in the database on a
+// fixed number of workers. Jobs are persisted before the upload request
+// returns, so they survive restarts.
+type processingQueue struct {
+	workers     int
+	maxAttempts int
+	wake        chan struct{}
+}
+
+func newProcessingQueue(workers, maxAttempts int) *processingQueue {
+	if workers < 1 {
+		workers = 1
+	}
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	return &processingQueue{
+		workers:     workers,
+		maxAttempts: maxAttempts,
+		wake:        make(chan struct{}, 1),
+	}
+}
+
+// notify wakes an idle worker without waiting for the next poll.
+func (q *processingQueue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// enqueueProcessing sniffs and probes sourcePath and hands it over to the
+// processing queue. The file must live somewhere durable (cfg.uploadsRoot);
+// the queue deletes it once the job finishes for good. Files in a container
+// that isn't allowed, that ffprobe can't read or that use unsupported codecs
+// are rejected with an error wrapping errUnsupportedVideo and stay the
+// caller's to clean up. The client's claimed content type is never trusted.
+// With trim, only those parts of the source are kept (see trimVideo). A file
+// assembled by a resumable upload passes its session, which is completed in
+// the same transaction that queues the job.
+func (cfg *apiConfig) enqueueProcessing(ctx context.Context, video database.Video, sourcePath, sourceSHA256 string, trim database.TimeRanges, uploadSessionID *uuid.UUID) (_ database.Video, err error) {
+	cfg.events.publish(video.ID, videoEvent{Type: videoEventUploadReceived})
+	defer func() {
+		if err != nil {
+			cfg.events.publish(video.ID, videoEvent{Type: videoEventFailed, Error: err.Error()})
+		}
+	}()
+
+	format, err := cfg.sniffVideoFile(sourcePath)
+	if err != nil {
+		return video, err
+	}
+	// Handlers that stream the upload to disk hash it on the way.
+	if sourceSHA256 == "" {
+		sourceSHA256, err = hashFile(sourcePath)
+		if err != nil {
+			return video, err
+		}
+	}
+	cfg.events.publish(video.ID, videoEvent{Type: videoEventProbing})
+	probe, err := probeMedia(ctx, sourcePath)
+	if err != nil {
+		return video, fmt.Errorf("%w: %v", errUnsupportedVideo, err)
+	}
+	err = cfg.validateCodecs(probe)
+	if err != nil {
+		return video, err
+	}
+	video.VideoMetadata = probe.metadata()
+	err = cfg.db.UpdateVideoMetadata(video.ID, video.VideoMetadata)
+	if err != nil {
+		return video, err
+	}
+
+	_, err = cfg.db.CreateProcessingJob(database.CreateProcessingJobParams{
+		VideoID:         video.ID,
+		SourcePath:      sourcePath,
+		SourceSHA256:    sourceSHA256,
+		MediaType:       format.mediaType,
+		Trim:            trim,
+		UploadSessionID: uploadSessionID,
+	})
+	if err != nil {
+		return video, err
+	}
+
+	video.ProcessingStatus = database.ProcessingStatusPending
+	video.ProcessingError = nil
+	err = cfg.db.SetVideoProcessingStatus(video.ID, video.ProcessingStatus, nil)
+	if err != nil {
+		return video, err
+	}
+
+	cfg.events.publish(video.ID, videoEvent{Type: videoEventQueued})
+	cfg.processing.notify()
+	return video, nil
+}
+
+func (cfg *apiConfig) startProcessingWorkers(ctx context.Context) error {
+	requeued, err := cfg.db.RequeueInterruptedProcessingJobs()
+	if err != nil {
+		return err
+	}
+	if requeued > 0 {
+		log.Printf("Requeued %d interrupted processing jobs", requeued)
+	}
+
+	for i := 0; i < cfg.processing.workers; i++ {
+		go cfg.processingWorker(ctx)
+	}
+	return nil
+}
+
+func (cfg *apiConfig) processingWorker(ctx context.Context) {
+	ticker := time.NewTicker(processingPollInterval)
+	defer ticker.Stop()
+
+	for {
+		job, err := cfg.db.ClaimProcessingJob()
+		if err != nil {
+			log.Printf("Couldn't claim processing job: %v", err)
+		}
+		if err == nil && job.ID != uuid.Nil {
+			cfg.runProcessingJob(ctx, job)
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-cfg.processing.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+func (cfg *apiConfig) runProcessingJob(ctx context.Context, job database.ProcessingJob) {
+	err := cfg.processJob(ctx, job)
+	if err == nil {
+		err = cfg.db.CompleteProcessingJob(job.ID)
+		if err != nil {
+			log.Printf("Couldn't complete processing job %s: %v", job.ID, err)
+		}
+		cfg.removeUpload(job.SourcePath)
+		cfg.events.publish(job.VideoID, videoEvent{Type: videoEventDone})
+		return
+	}
+
+	log.Printf("Processing job %s for video %s failed (attempt %d/%d): %v", job.ID, job.VideoID, job.Attempts, cfg.processing.maxAttempts, err)
+	errMessage := err.Error()
+
+	if errors.Is(err, errJobNotRetryable) || job.Attempts >= cfg.processing.maxAttempts {
+		err = cfg.db.FailProcessingJob(job.ID, errMessage)
+		if err != nil {
+			log.Printf("Couldn't fail processing job %s: %v", job.ID, err)
+		}
+		// A video that fails to be processed again still has what it had.
+		status := database.ProcessingStatusFailed
+		if job.Reprocess {
+			status = database.ProcessingStatusReady
+		}
+		err = cfg.db.SetVideoProcessingStatus(job.VideoID, status, &errMessage)
+		if err != nil {
+			log.Printf("Couldn't update video %s: %v", job.VideoID, err)
+		}
+		cfg.removeUpload(job.SourcePath)
+		cfg.events.publish(job.VideoID, videoEvent{Type: videoEventFailed, Error: errMessage})
+		return
+	}
+
+	err = cfg.db.RetryProcessingJob(job.ID, errMessage, processingBackoff(job.Attempts))
+	if err != nil {
+		log.Printf("Couldn't reschedule processing job %s: %v", job.ID, err)
+	}
+	err = cfg.db.SetVideoProcessingStatus(job.VideoID, database.ProcessingStatusPending, &errMessage)
+	if err != nil {
+		log.Printf("Couldn't update video %s: %v", job.VideoID, err)
+	}
+	cfg.events.publish(job.VideoID, videoEvent{Type: videoEventRetrying, Error: errMessage})
+}
+
+var errJobNotRetryable = errors.New("job can't be retried")
+
+func (cfg *apiConfig) processJob(ctx context.Context, job database.ProcessingJob) error {
+	video, err := cfg.db.GetVideo(job.VideoID)
+	if err != nil {
+		return err
+	}
+	if video.ID == uuid.Nil {
+		return fmt.Errorf("%w: video %s was deleted", errJobNotRetryable, job.VideoID)
+	}
+	if _, err := os.Stat(job.SourcePath); err != nil && !job.Reprocess {
+		return fmt.Errorf("%w: source file is gone: %v", errJobNotRetryable, err)
+	}
+
+	err = cfg.db.SetVideoProcessingStatus(video.ID, database.ProcessingStatusProcessing, nil)
+	if err != nil {
+		return err
+	}
+	cfg.events.publish(video.ID, videoEvent{Type: videoEventProcessing})
+
+	sourcePath, mediaType, sourceSHA256 := job.SourcePath, job.MediaType, job.SourceSHA256
+	if job.Reprocess {
+		sourcePath, mediaType, sourceSHA256, err = cfg.fetchProcessingSource(ctx, video)
+		if err != nil {
+			return fmt.Errorf("couldn't fetch video to process again: %w", err)
+		}
+		defer cfg.removeUpload(sourcePath)
+	}
+	if len(job.Trim) > 0 {
+		sourcePath, err = cfg.trimVideo(ctx, video.ID, sourcePath, job.Trim)
+		if err != nil {
+			return fmt.Errorf("couldn't trim video: %w", err)
+		}
+		err = cfg.claimUpload(sourcePath)
+		if err != nil {
+			return err
+		}
+		defer cfg.removeUpload(sourcePath)
+		mediaType = "video/mp4"
+
+		// What was probed at upload was the whole source.
+		probe, err := probeMedia(ctx, sourcePath)
+		if err != nil {
+			return fmt.Errorf("couldn't probe trimmed video: %w", err)
+		}
+		err = cfg.db.UpdateVideoMetadata(video.ID, probe.metadata())
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = cfg.processVideo(ctx, video, sourcePath, mediaType, sourceSHA256)
+	return err
+}
+
+// processingBackoff doubles the wait after every failed attempt.
+func processingBackoff(attempts int) time.Duration {
+	backoff := processingBaseBackoff
+	for i := 1; i < attempts; i++ {
+		backoff *= 2
+		if backoff >= processingMaxBackoff {
+			return processingMaxBackoff
+		}
+	}
+	return backoff
+}
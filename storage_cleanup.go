@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+const (
+	storageCleanupPollInterval = 30 * time.Second
+	storageCleanupBatchSize    = 50
+	storageCleanupBaseBackoff  = time.Minute
+	storageCleanupMaxBackoff   = 6 * time.Hour
+)
+
+// storageCleanup deletes objects queued in the storage_deletions outbox.
+// Failed deletes are retried with backoff until they go through, so a
+// storage hiccup never leaks media.
+type storageCleanup struct {
+	wake chan struct{}
+}
+
+func newStorageCleanup() *storageCleanup {
+	return &storageCleanup{wake: make(chan struct{}, 1)}
+}
+
+func (c *storageCleanup) notify() {
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// videoMediaPrefix is where everything derived from a processed video lives:
+// "landscape/abc.mp4" keeps its renditions under "landscape/abc/".
+func videoMediaPrefix(videoKey string) string {
+	return strings.TrimSuffix(videoKey, path.Ext(videoKey)) + "/"
+}
+
+// thumbnailKeyPrefix holds processed thumbnails, a directory of variants
+// each. Thumbnails stored before they were processed sit at the top level.
+const thumbnailKeyPrefix = "thumbnails/"
+
+// thumbnailMediaPrefix is the directory of the thumbnail whose largest
+// variant is at key, if it has one.
+func thumbnailMediaPrefix(key string) (string, bool) {
+	if !strings.HasPrefix(key, thumbnailKeyPrefix) {
+		return "", false
+	}
+	return path.Dir(key) + "/", true
+}
+
+// videoMediaReleases lists every stored object that belongs to video.
+func (cfg *apiConfig) videoMediaReleases(video database.Video) []database.MediaRelease {
+	releases := cfg.videoMediaRelease(video.VideoURL)
+	releases = append(releases, cfg.thumbnailMediaRelease(video.ThumbnailURL)...)
+	releases = append(releases, cfg.mediaRelease(video.OriginalKey)...)
+	// Captions aren't in blobs, they go with the video.
+	captions := captionsPrefix(video.ID)
+	return append(releases, database.MediaRelease{
+		Key:       captions,
+		Deletions: []database.StorageDeletionParams{{Key: captions, Prefix: true}},
+	})
+}
+
+// mediaRelease gives up a reference to the object stored points at.
+func (cfg *apiConfig) mediaRelease(stored *string) []database.MediaRelease {
+	if stored == nil {
+		return nil
+	}
+	key, ok := cfg.objectKey(*stored)
+	if !ok {
+		return nil
+	}
+	return []database.MediaRelease{{
+		Key:       key,
+		Deletions: []database.StorageDeletionParams{{Key: key}},
+	}}
+}
+
+// videoMediaRelease is like mediaRelease for a processed video, which takes
+// its HLS renditions and other derived files with it.
+func (cfg *apiConfig) videoMediaRelease(stored *string) []database.MediaRelease {
+	releases := cfg.mediaRelease(stored)
+	if len(releases) == 0 || !strings.Contains(releases[0].Key, "/") {
+		return releases
+	}
+	releases[0].Deletions = append(releases[0].Deletions, database.StorageDeletionParams{
+		Key:    videoMediaPrefix(releases[0].Key),
+		Prefix: true,
+	})
+	return releases
+}
+
+// thumbnailMediaRelease is like mediaRelease for a thumbnail, which takes its
+// other variants with it.
+func (cfg *apiConfig) thumbnailMediaRelease(stored *string) []database.MediaRelease {
+	releases := cfg.mediaRelease(stored)
+	if len(releases) == 0 {
+		return releases
+	}
+	if prefix, ok := thumbnailMediaPrefix(releases[0].Key); ok {
+		releases[0].Deletions = append(releases[0].Deletions, database.StorageDeletionParams{
+			Key:    prefix,
+			Prefix: true,
+		})
+	}
+	return releases
+}
+
+// releaseMedia is for references that aren't given up as part of a change
+// to a video row, such as media that never got attached to one.
+func (cfg *apiConfig) releaseMedia(released []database.MediaRelease) {
+	if len(released) == 0 {
+		return
+	}
+	err := cfg.db.ReleaseMedia(released)
+	if err != nil {
+		log.Printf("Couldn't release %d stored objects: %v", len(released), err)
+		return
+	}
+	cfg.storageCleanup.notify()
+}
+
+func (cfg *apiConfig) startStorageCleanup(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(storageCleanupPollInterval)
+		defer ticker.Stop()
+		for {
+			cfg.runStorageDeletions(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-cfg.storageCleanup.wake:
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (cfg *apiConfig) runStorageDeletions(ctx context.Context) {
+	for {
+		deletions, err := cfg.db.GetDueStorageDeletions(storageCleanupBatchSize)
+		if err != nil {
+			log.Printf("Couldn't load storage deletions: %v", err)
+			return
+		}
+		for _, deletion := range deletions {
+			err := cfg.deleteStored(ctx, deletion.StorageDeletionParams)
+			if err != nil {
+				log.Printf("Couldn't delete %s from storage (attempt %d): %v", deletion.Key, deletion.Attempts+1, err)
+				err = cfg.db.RetryStorageDeletion(deletion.ID, err.Error(), storageCleanupBackoff(deletion.Attempts+1))
+				if err != nil {
+					log.Printf("Couldn't reschedule storage deletion %s: %v", deletion.ID, err)
+				}
+				continue
+			}
+			err = cfg.db.CompleteStorageDeletion(deletion.ID)
+			if err != nil {
+				log.Printf("Couldn't complete storage deletion %s: %v", deletion.ID, err)
+			}
+		}
+		if len(deletions) < storageCleanupBatchSize {
+			return
+		}
+	}
+}
+
+func (cfg *apiConfig) deleteStored(ctx context.Context, deletion database.StorageDeletionParams) error {
+	if !deletion.Prefix {
+		return cfg.storage.Delete(ctx, deletion.Key)
+	}
+	// An empty or top level prefix would take unrelated media with it.
+	if deletion.Key == "" || !strings.HasSuffix(deletion.Key, "/") || deletion.Key == "/" {
+		return fmt.Errorf("refusing to delete prefix %q", deletion.Key)
+	}
+	objects, err := cfg.storage.List(ctx, deletion.Key)
+	if err != nil {
+		return err
+	}
+	for _, object := range objects {
+		err := cfg.storage.Delete(ctx, object.Key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func storageCleanupBackoff(attempts int) time.Duration {
+	backoff := storageCleanupBaseBackoff
+	for i := 1; i < attempts; i++ {
+		backoff *= 2
+		if backoff >= storageCleanupMaxBackoff {
+			return storageCleanupMaxBackoff
+		}
+	}
+	return backoff
+}
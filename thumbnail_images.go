@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math"
+)
+
+// thumbnailWidths are the sizes every thumbnail is resized to, for srcset.
+// Images are never upscaled: a narrower image gets the widths below its own
+// plus one at its own width.
+var thumbnailWidths = []int{320, 640, 1280}
+
+// thumbnailMaxPixels bounds how large an image we're willing to decode,
+// a small file can claim enormous dimensions.
+const thumbnailMaxPixels = 16 << 20
+
+const thumbnailJPEGQuality = 85
+
+var errInvalidImage = errors.New("thumbnail must be a JPEG or PNG image")
+
+// thumbnailVariant is one encoded size of a thumbnail.
+type thumbnailVariant struct {
+	width       int
+	height      int
+	data        []byte
+	extension   string
+	contentType string
+}
+
+// processThumbnail decodes an uploaded image, whatever its claimed type,
+// and re-encodes it at each of thumbnailWidths, largest last. Re-encoding
+// drops EXIF and any other metadata; the EXIF orientation is applied to the
+// pixels first so photos don't end up sideways. Images with transparency
+// stay PNG, everything else becomes JPEG. WebP isn't offered: the standard
+// library has no encoder for it.
+func processThumbnail(r io.ReadSeeker) ([]thumbnailVariant, error) {
+	config, format, err := image.DecodeConfig(r)
+	if err != nil || (format != "jpeg" && format != "png") {
+		return nil, errInvalidImage
+	}
+	if config.Width <= 0 || config.Height <= 0 || config.Width*config.Height > thumbnailMaxPixels {
+		return nil, fmt.Errorf("%w: %dx%d is too large", errInvalidImage, config.Width, config.Height)
+	}
+
+	_, err = r.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	decoded, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidImage, err)
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, decoded.Bounds().Dx(), decoded.Bounds().Dy()))
+	draw.Draw(img, img.Bounds(), decoded, decoded.Bounds().Min, draw.Src)
+	if format == "jpeg" {
+		img = applyOrientation(img, jpegOrientation(data))
+	}
+	opaque := img.Opaque()
+
+	variants := []thumbnailVariant{}
+	for _, width := range variantWidths(img.Bounds().Dx()) {
+		height := max(1, int(math.Round(float64(img.Bounds().Dy())*float64(width)/float64(img.Bounds().Dx()))))
+		resized := img
+		if width != img.Bounds().Dx() {
+			resized = resizeImage(img, width, height)
+		}
+
+		variant := thumbnailVariant{width: width, height: height}
+		var buf bytes.Buffer
+		if opaque {
+			err = jpeg.Encode(&buf, resized, &jpeg.Options{Quality: thumbnailJPEGQuality})
+			variant.extension, variant.contentType = "jpg", "image/jpeg"
+		} else {
+			err = png.Encode(&buf, resized)
+			variant.extension, variant.contentType = "png", "image/png"
+		}
+		if err != nil {
+			return nil, err
+		}
+		variant.data = buf.Bytes()
+		variants = append(variants, variant)
+	}
+	return variants, nil
+}
+
+func variantWidths(sourceWidth int) []int {
+	widths := []int{}
+	for _, width := range thumbnailWidths {
+		if width >= sourceWidth {
+			return append(widths, sourceWidth)
+		}
+		widths = append(widths, width)
+	}
+	return widths
+}
+
+// resizeImage scales src to width x height by area averaging: every output
+// pixel is the mean of the source pixels it covers, which is what you want
+// when shrinking. It works in two passes, horizontal then vertical.
+func resizeImage(src *image.RGBA, width, height int) *image.RGBA {
+	srcWidth, srcHeight := src.Bounds().Dx(), src.Bounds().Dy()
+	xWeights := areaWeights(srcWidth, width)
+	yWeights := areaWeights(srcHeight, height)
+
+	// Premultiplied RGBA averages correctly across transparent edges.
+	tmp := make([]float32, width*srcHeight*4)
+	for y := 0; y < srcHeight; y++ {
+		row := src.Pix[y*src.Stride:]
+		for x, weights := range xWeights {
+			var r, g, b, a float32
+			for _, w := range weights {
+				p := row[w.index*4:]
+				r += float32(p[0]) * w.weight
+				g += float32(p[1]) * w.weight
+				b += float32(p[2]) * w.weight
+				a += float32(p[3]) * w.weight
+			}
+			t := tmp[(y*width+x)*4:]
+			t[0], t[1], t[2], t[3] = r, g, b, a
+		}
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y, weights := range yWeights {
+		row := dst.Pix[y*dst.Stride:]
+		for x := 0; x < width; x++ {
+			var r, g, b, a float32
+			for _, w := range weights {
+				t := tmp[(w.index*width+x)*4:]
+				r += t[0] * w.weight
+				g += t[1] * w.weight
+				b += t[2] * w.weight
+				a += t[3] * w.weight
+			}
+			p := row[x*4:]
+			p[0], p[1], p[2], p[3] = clampByte(r), clampByte(g), clampByte(b), clampByte(a)
+		}
+	}
+	return dst
+}
+
+type areaWeight struct {
+	index  int
+	weight float32
+}
+
+// areaWeights works out, for every output pixel along one axis, which
+// source pixels it covers and by how much. The weights of each output
+// pixel add up to 1.
+func areaWeights(srcSize, dstSize int) [][]areaWeight {
+	scale := float64(srcSize) / float64(dstSize)
+	weights := make([][]areaWeight, dstSize)
+	for i := range weights {
+		start, end := float64(i)*scale, float64(i+1)*scale
+		for j := int(start); j < srcSize && float64(j) < end; j++ {
+			overlap := math.Min(end, float64(j+1)) - math.Max(start, float64(j))
+			if overlap <= 0 {
+				continue
+			}
+			weights[i] = append(weights[i], areaWeight{index: j, weight: float32(overlap / scale)})
+		}
+	}
+	return weights
+}
+
+func clampByte(v float32) uint8 {
+	if v <= 0 {
+		return 0
+	}
+	if v >= 255 {
+		return 255
+	}
+	return uint8(v + 0.5)
+}
+
+// jpegOrientation reads the EXIF orientation tag (1 to 8) from a JPEG, or
+// returns 1, the identity, if there isn't one.
+func jpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xFF {
+			return 1
+		}
+		marker := data[i+1]
+		// Start of scan: the metadata segments are all behind us.
+		if marker == 0xDA || marker == 0xD9 {
+			return 1
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		if length < 2 || i+2+length > len(data) {
+			return 1
+		}
+		segment := data[i+4 : i+2+length]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return exifOrientation(segment[6:])
+		}
+		i += 2 + length
+	}
+	return 1
+}
+
+// exifOrientation finds the orientation tag in IFD0 of a TIFF structure.
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for n := 0; n < entries; n++ {
+		entry := ifd + 2 + n*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:]) != 0x0112 {
+			continue
+		}
+		orientation := int(order.Uint16(tiff[entry+8:]))
+		if orientation < 1 || orientation > 8 {
+			return 1
+		}
+		return orientation
+	}
+	return 1
+}
+
+// applyOrientation turns an image stored with EXIF orientation o upright.
+func applyOrientation(src *image.RGBA, o int) *image.RGBA {
+	if o <= 1 || o > 8 {
+		return src
+	}
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	dw, dh := w, h
+	if o >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch o {
+			case 2: // mirrored
+				dx, dy = w-1-x, y
+			case 3: // rotated 180°
+				dx, dy = w-1-x, h-1-y
+			case 4: // mirrored vertically
+				dx, dy = x, h-1-y
+			case 5: // transposed
+				dx, dy = y, x
+			case 6: // rotated 90° clockwise to display
+				dx, dy = h-1-y, x
+			case 7: // transversed
+				dx, dy = h-1-y, w-1-x
+			case 8: // rotated 90° counter-clockwise to display
+				dx, dy = y, w-1-x
+			}
+			copy(dst.Pix[dy*dst.Stride+dx*4:dy*dst.Stride+dx*4+4], src.Pix[y*src.Stride+x*4:])
+		}
+	}
+	return dst
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+var (
+	errTooManyUploads = errors.New("too many uploads in progress, try again later")
+	errUploadDiskFull = errors.New("no room for more uploads right now, try again later")
+	errNoFilePart     = errors.New("no file part in form")
+)
+
+// uploadLimiter keeps a burst of uploads from exhausting the server: it caps
+// how many upload requests are received at once and how many bytes the files
+// in uploadsRoot may take up in total. Zero disables either limit.
+type uploadLimiter struct {
+	slots chan struct{}
+
+	mu        sync.Mutex
+	maxBytes  int64
+	usedBytes int64
+}
+
+func newUploadLimiter(maxConcurrent int, maxBytes, usedBytes int64) *uploadLimiter {
+	l := &uploadLimiter{maxBytes: maxBytes, usedBytes: usedBytes}
+	if maxConcurrent > 0 {
+		l.slots = make(chan struct{}, maxConcurrent)
+	}
+	return l
+}
+
+func (l *uploadLimiter) tryAcquire() bool {
+	if l.slots == nil {
+		return true
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (l *uploadLimiter) release() {
+	if l.slots != nil {
+		<-l.slots
+	}
+}
+
+// reserve claims n bytes of disk, or fails with errUploadDiskFull.
+func (l *uploadLimiter) reserve(n int64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.maxBytes > 0 && l.usedBytes+n > l.maxBytes {
+		return errUploadDiskFull
+	}
+	l.usedBytes += n
+	return nil
+}
+
+func (l *uploadLimiter) free(n int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.usedBytes -= n
+	if l.usedBytes < 0 {
+		l.usedBytes = 0
+	}
+}
+
+// writer reserves disk for everything written through it to w.
+func (l *uploadLimiter) writer(w io.Writer) io.Writer {
+	return budgetedWriter{w: w, limiter: l}
+}
+
+type budgetedWriter struct {
+	w       io.Writer
+	limiter *uploadLimiter
+}
+
+func (b budgetedWriter) Write(p []byte) (int, error) {
+	err := b.limiter.reserve(int64(len(p)))
+	if err != nil {
+		return 0, err
+	}
+	n, err := b.w.Write(p)
+	b.limiter.free(int64(len(p) - n))
+	return n, err
+}
+
+// limitUploads turns requests away with 503 while the server is already
+// receiving as many uploads as it's allowed to.
+func (cfg *apiConfig) limitUploads(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !cfg.uploadLimits.tryAcquire() {
+			w.Header().Set("Retry-After", "30")
+			respondWithError(w, http.StatusServiceUnavailable, errTooManyUploads.Error(), nil)
+			return
+		}
+		defer cfg.uploadLimits.release()
+		next(w, r)
+	}
+}
+
+// removeUpload deletes a file in uploadsRoot and gives its space back to the
+// disk budget.
+func (cfg *apiConfig) removeUpload(filePath string) {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return
+	}
+	err = os.Remove(filePath)
+	if err != nil {
+		log.Printf("Couldn't remove upload %s: %v", filePath, err)
+		return
+	}
+	cfg.uploadLimits.free(info.Size())
+}
+
+// claimUpload counts a file in uploadsRoot that wasn't written through
+// uploadLimiter.writer, such as ffmpeg's output, against the disk budget, so
+// that removeUpload can give its space back. A file that doesn't fit is
+// removed.
+func (cfg *apiConfig) claimUpload(filePath string) error {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return err
+	}
+	err = cfg.uploadLimits.reserve(info.Size())
+	if err != nil {
+		os.Remove(filePath)
+		return err
+	}
+	return nil
+}
+
+// removeStrayUploads deletes the files under root that no upload session or
+// unfinished processing job owns: temp files and ffmpeg output left behind
+// when the server stopped in the middle of a request or job. It has to run
+// before anything else writes to root.
+func removeStrayUploads(db database.Client, root string) (int, error) {
+	owned, err := db.GetOwnedUploadPaths()
+	if err != nil {
+		return 0, err
+	}
+	keep := map[string]bool{}
+	for _, filePath := range owned {
+		abs, err := filepath.Abs(filePath)
+		if err != nil {
+			return 0, err
+		}
+		keep[abs] = true
+	}
+
+	removed := 0
+	err = filepath.WalkDir(root, func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		abs, err := filepath.Abs(filePath)
+		if err != nil {
+			return err
+		}
+		if keep[abs] {
+			return nil
+		}
+		err = os.Remove(filePath)
+		if err != nil {
+			return err
+		}
+		removed++
+		return nil
+	})
+	return removed, err
+}
+
+// uploadsDiskUsage adds up the sizes of the files under root.
+func uploadsDiskUsage(root string) (int64, error) {
+	var total int64
+	err := filepath.WalkDir(root, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		total += info.Size()
+		return nil
+	})
+	return total, err
+}
+
+// formFilePart reads a multipart request up to the part called name and
+// returns it for the caller to stream, instead of buffering the whole form
+// the way ParseMultipartForm does. Parts before it are skipped.
+func formFilePart(r *http.Request, name string) (*multipart.Part, error) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		part, err := reader.NextPart()
+		if errors.Is(err, io.EOF) {
+			return nil, errNoFilePart
+		}
+		if err != nil {
+			return nil, err
+		}
+		if part.FormName() == name {
+			return part, nil
+		}
+		part.Close()
+	}
+}
+
+// respondWithUploadError reports an upload that couldn't be written to disk,
+// telling clients whether it was too large or may be retried later.
+func respondWithUploadError(w http.ResponseWriter, msg string, err error) {
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.As(err, &maxBytesErr):
+		respondWithError(w, http.StatusRequestEntityTooLarge, "File is too large", err)
+	case errors.Is(err, errUploadDiskFull):
+		w.Header().Set("Retry-After", "30")
+		respondWithError(w, http.StatusServiceUnavailable, errUploadDiskFull.Error(), err)
+	default:
+		respondWithError(w, http.StatusInternalServerError, msg, err)
+	}
+}
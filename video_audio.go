@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/google/uuid"
+)
+
+const (
+	audioFormatM4A  = "m4a"
+	audioFormatMP3  = "mp3"
+	audioFormatNone = "none"
+
+	audioBitrate = 128 // kbit/s
+
+	waveformFile = "waveform.json"
+	// waveformSampleRate is what the audio is resampled to before looking
+	// for peaks, plenty for drawing.
+	waveformSampleRate = 8000
+)
+
+// waveform is the JSON format of BBC's audiowaveform, which waveform UIs
+// such as peaks.js and wavesurfer.js read. Data is a min and a max per
+// bucket of SamplesPerPixel samples, as 8 bit values.
+type waveform struct {
+	Version         int    `json:"version"`
+	Channels        int    `json:"channels"`
+	SampleRate      int    `json:"sample_rate"`
+	SamplesPerPixel int    `json:"samples_per_pixel"`
+	Bits            int    `json:"bits"`
+	Length          int    `json:"length"`
+	Data            []int8 `json:"data"`
+}
+
+// generateAudio extracts an audio only rendition in cfg.audioFormat and
+// the waveform peaks of the video's audio, uploads them under prefix and
+// returns their keys. Either is nil when turned off, and both are when the
+// video has no audio.
+func (cfg *apiConfig) generateAudio(ctx context.Context, videoID uuid.UUID, videoPath, prefix string, probe mediaProbe) (audioKey, waveformKey *string, err error) {
+	if probe.AudioCodec == "" || (cfg.audioFormat == audioFormatNone && cfg.waveformRate <= 0) {
+		return nil, nil, nil
+	}
+	outputDir, err := os.MkdirTemp("", "tubely-audio-")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer os.RemoveAll(outputDir)
+
+	if cfg.audioFormat != audioFormatNone {
+		name := "audio." + cfg.audioFormat
+		err = extractAudio(ctx, videoPath, filepath.Join(outputDir, name), cfg.audioFormat, probe.Duration, cfg.events.progressPublisher(videoID, "audio"))
+		if err != nil {
+			return nil, nil, fmt.Errorf("couldn't extract audio: %w", err)
+		}
+		key := prefix + name
+		audioKey = &key
+	}
+	if cfg.waveformRate > 0 {
+		peaks, err := cfg.waveformPeaks(ctx, videoID, videoPath, outputDir, probe.Duration)
+		if err != nil {
+			return nil, nil, fmt.Errorf("couldn't compute waveform: %w", err)
+		}
+		data, err := json.Marshal(peaks)
+		if err != nil {
+			return nil, nil, err
+		}
+		err = os.WriteFile(filepath.Join(outputDir, waveformFile), data, 0644)
+		if err != nil {
+			return nil, nil, err
+		}
+		key := prefix + waveformFile
+		waveformKey = &key
+	}
+
+	cfg.events.publish(videoID, videoEvent{Type: videoEventUploading, Stage: "audio"})
+	err = cfg.putDir(ctx, outputDir, prefix)
+	if err != nil {
+		return nil, nil, err
+	}
+	return audioKey, waveformKey, nil
+}
+
+func extractAudio(ctx context.Context, videoPath, outputPath, format string, duration float64, progress func(float64)) error {
+	args := []string{
+		"-y",
+		"-i", videoPath,
+		"-map", "0:a:0",
+		"-vn",
+		"-b:a", fmt.Sprintf("%dk", audioBitrate),
+	}
+	switch format {
+	case audioFormatM4A:
+		args = append(args, "-c:a", "aac", "-movflags", "faststart", "-f", "mp4")
+	case audioFormatMP3:
+		args = append(args, "-c:a", "libmp3lame", "-f", "mp3")
+	default:
+		return fmt.Errorf("unknown audio format %q", format)
+	}
+	return runFFmpeg(ctx, append(args, outputPath), duration, progress)
+}
+
+// waveformPeaks decodes the audio to mono PCM in workDir and reduces it to
+// cfg.waveformRate min/max pairs per second.
+func (cfg *apiConfig) waveformPeaks(ctx context.Context, videoID uuid.UUID, videoPath, workDir string, duration float64) (waveform, error) {
+	pcmPath := filepath.Join(workDir, "waveform.pcm")
+	defer os.Remove(pcmPath)
+	err := runFFmpeg(ctx, []string{
+		"-y",
+		"-i", videoPath,
+		"-map", "0:a:0",
+		"-vn",
+		"-ac", "1",
+		"-ar", fmt.Sprint(waveformSampleRate),
+		"-f", "s16le",
+		pcmPath,
+	}, duration, cfg.events.progressPublisher(videoID, "waveform"))
+	if err != nil {
+		return waveform{}, err
+	}
+
+	pcm, err := os.Open(pcmPath)
+	if err != nil {
+		return waveform{}, err
+	}
+	defer pcm.Close()
+
+	samplesPerPixel := max(1, waveformSampleRate/cfg.waveformRate)
+	peaks := waveform{
+		Version:         2,
+		Channels:        1,
+		SampleRate:      waveformSampleRate,
+		SamplesPerPixel: samplesPerPixel,
+		Bits:            8,
+		Data:            []int8{},
+	}
+	reader := bufio.NewReader(pcm)
+	sample := make([]byte, 2)
+	var low, high int16
+	n := 0
+	for {
+		_, err := io.ReadFull(reader, sample)
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		}
+		if err != nil {
+			return waveform{}, err
+		}
+		value := int16(binary.LittleEndian.Uint16(sample))
+		if n == 0 || value < low {
+			low = value
+		}
+		if n == 0 || value > high {
+			high = value
+		}
+		n++
+		if n == samplesPerPixel {
+			peaks.Data = append(peaks.Data, int8(low>>8), int8(high>>8))
+			n = 0
+		}
+	}
+	if n > 0 {
+		peaks.Data = append(peaks.Data, int8(low>>8), int8(high>>8))
+	}
+	peaks.Length = len(peaks.Data) / 2
+	return peaks, nil
+}
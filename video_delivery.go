@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+	"github.com/google/uuid"
+)
+
+const (
+	// deliveryModeCDN hands out cfg.storage.URL links, usually CloudFront,
+	// signed for unlisted and private videos.
+	deliveryModeCDN = "cdn"
+	// deliveryModePresigned hands out presigned S3 GET URLs for every
+	// video, for deployments without a distribution in front of the bucket.
+	deliveryModePresigned = "presigned"
+)
+
+// presentVideo turns a video row into what API responses hand out. The row
+// holds storage keys (the bucket is fixed per deployment), the URLs are
+// built here from the current delivery configuration. In CDN mode public
+// videos get plain URLs and unlisted and private ones signed URLs that
+// expire after cfg.signedURLTTL; in presigned mode every URL expires after
+// cfg.presignedURLTTL.
+func (cfg *apiConfig) presentVideo(ctx context.Context, video database.Video) database.Video {
+	if cfg.deliveryMode == deliveryModePresigned {
+		return cfg.presentVideoPresigned(ctx, video)
+	}
+
+	video.VideoURL = cfg.objectURL(video.VideoURL)
+	video.ThumbnailURL = cfg.objectURL(video.ThumbnailURL)
+	video.ThumbnailVariants = presentImageVariants(video.ThumbnailVariants, cfg.objectURL)
+	video.HLSURL = cfg.objectURL(video.HLSURL)
+	video.ThumbnailTrackURL = cfg.objectURL(video.ThumbnailTrackURL)
+	video.SpriteSheets = presentImageVariants(video.SpriteSheets, cfg.objectURL)
+	video.PreviewURL = cfg.objectURL(video.PreviewURL)
+	video.AudioURL = cfg.objectURL(video.AudioURL)
+	video.WaveformURL = cfg.objectURL(video.WaveformURL)
+	video.Captions = presentCaptions(cfg.videoCaptions(video.ID), cfg.objectURL)
+	if video.Visibility == database.VisibilityPublic || video.Visibility == "" {
+		return video
+	}
+	if cfg.urlSigner == nil {
+		// Visibility can only be changed with signing configured, so this
+		// means the configuration was removed since. Hand out nothing rather
+		// than permanent links.
+		log.Printf("Video %s is %s but URL signing isn't configured, leaving out its URLs", video.ID, video.Visibility)
+		video.VideoURL = nil
+		video.ThumbnailURL = nil
+		video.ThumbnailVariants = nil
+		video.HLSURL = nil
+		video.ThumbnailTrackURL = nil
+		video.SpriteSheets = nil
+		video.PreviewURL = nil
+		video.AudioURL = nil
+		video.WaveformURL = nil
+		video.Captions = nil
+		return video
+	}
+
+	expires := time.Now().Add(cfg.signedURLTTL)
+	video.VideoURL = cfg.signURL(video.ID, video.VideoURL, expires)
+	video.ThumbnailURL = cfg.signURL(video.ID, video.ThumbnailURL, expires)
+	video.PreviewURL = cfg.signURL(video.ID, video.PreviewURL, expires)
+	video.AudioURL = cfg.signURL(video.ID, video.AudioURL, expires)
+	video.WaveformURL = cfg.signURL(video.ID, video.WaveformURL, expires)
+	video.Captions = presentCaptions(video.Captions, func(rawURL *string) *string {
+		return cfg.signURL(video.ID, rawURL, expires)
+	})
+	video.ThumbnailVariants = presentImageVariants(video.ThumbnailVariants, func(rawURL *string) *string {
+		return cfg.signURL(video.ID, rawURL, expires)
+	})
+	// The playlists refer to renditions, segments and caption playlists by
+	// relative URIs, which don't carry the query string signature, so HLS
+	// isn't offered, as in presigned mode. Players fall back to the MP4. The
+	// thumbnail track refers to its sheets the same way; the sheets are
+	// still handed out, signed one by one.
+	video.HLSURL = nil
+	video.ThumbnailTrackURL = nil
+	video.SpriteSheets = presentImageVariants(video.SpriteSheets, func(rawURL *string) *string {
+		return cfg.signURL(video.ID, rawURL, expires)
+	})
+	return video
+}
+
+func (cfg *apiConfig) presentVideoPresigned(ctx context.Context, video database.Video) database.Video {
+	presigner, ok := cfg.storage.(storage.Presigner)
+	if !ok {
+		// main refuses to start like this.
+		video.VideoURL, video.ThumbnailURL, video.HLSURL = nil, nil, nil
+		video.ThumbnailVariants, video.ThumbnailTrackURL, video.SpriteSheets = nil, nil, nil
+		video.PreviewURL, video.AudioURL, video.WaveformURL = nil, nil, nil
+		return video
+	}
+	video.VideoURL = cfg.presignObject(ctx, presigner, video.ID, video.VideoURL)
+	video.ThumbnailURL = cfg.presignObject(ctx, presigner, video.ID, video.ThumbnailURL)
+	video.PreviewURL = cfg.presignObject(ctx, presigner, video.ID, video.PreviewURL)
+	video.AudioURL = cfg.presignObject(ctx, presigner, video.ID, video.AudioURL)
+	video.WaveformURL = cfg.presignObject(ctx, presigner, video.ID, video.WaveformURL)
+	video.Captions = presentCaptions(cfg.videoCaptions(video.ID), func(stored *string) *string {
+		return cfg.presignObject(ctx, presigner, video.ID, stored)
+	})
+	video.ThumbnailVariants = presentImageVariants(video.ThumbnailVariants, func(stored *string) *string {
+		return cfg.presignObject(ctx, presigner, video.ID, stored)
+	})
+	// Segment URLs in the playlists are relative and a presigned URL only
+	// covers the one object, so HLS isn't offered. Players fall back to the
+	// MP4. The thumbnail track refers to its sheets the same way.
+	video.HLSURL = nil
+	video.ThumbnailTrackURL = nil
+	video.SpriteSheets = presentImageVariants(video.SpriteSheets, func(stored *string) *string {
+		return cfg.presignObject(ctx, presigner, video.ID, stored)
+	})
+	return video
+}
+
+func (cfg *apiConfig) presentVideos(ctx context.Context, videos []database.Video) []database.Video {
+	presented := make([]database.Video, len(videos))
+	for i, video := range videos {
+		presented[i] = cfg.presentVideo(ctx, video)
+	}
+	return presented
+}
+
+// presentImageVariants returns a copy of variants with each URL passed
+// through present, leaving out the ones it has no URL for.
+func presentImageVariants(variants database.ImageVariants, present func(*string) *string) database.ImageVariants {
+	if variants == nil {
+		return nil
+	}
+	presented := make(database.ImageVariants, 0, len(variants))
+	for _, variant := range variants {
+		url := present(&variant.URL)
+		if url == nil {
+			continue
+		}
+		variant.URL = *url
+		presented = append(presented, variant)
+	}
+	return presented
+}
+
+// videoCaptions loads the video's captions for presenting; without them
+// the video is still worth showing.
+func (cfg *apiConfig) videoCaptions(videoID uuid.UUID) []database.Caption {
+	captions, err := cfg.db.GetCaptions(videoID)
+	if err != nil {
+		log.Printf("Couldn't get captions of video %s: %v", videoID, err)
+		return nil
+	}
+	return captions
+}
+
+// presentCaptions returns the captions with each URL passed through
+// present, leaving out the ones it has no URL for.
+func presentCaptions(captions []database.Caption, present func(*string) *string) []database.Caption {
+	presented := []database.Caption{}
+	for _, caption := range captions {
+		url := present(&caption.URL)
+		if url == nil {
+			continue
+		}
+		caption.URL = *url
+		presented = append(presented, caption)
+	}
+	return presented
+}
+
+func (cfg *apiConfig) objectURL(stored *string) *string {
+	if stored == nil {
+		return nil
+	}
+	key, ok := cfg.objectKey(*stored)
+	if !ok {
+		return stored
+	}
+	objectURL := cfg.storage.URL(key)
+	return &objectURL
+}
+
+func (cfg *apiConfig) presignObject(ctx context.Context, presigner storage.Presigner, videoID uuid.UUID, stored *string) *string {
+	if stored == nil {
+		return nil
+	}
+	key, ok := cfg.objectKey(*stored)
+	if !ok {
+		log.Printf("Couldn't find the storage key of %q for video %s", *stored, videoID)
+		return nil
+	}
+	presigned, err := presigner.PresignGet(ctx, key, cfg.presignedURLTTL)
+	if err != nil {
+		log.Printf("Couldn't presign URL for video %s: %v", videoID, err)
+		return nil
+	}
+	return &presigned
+}
+
+func (cfg *apiConfig) signURL(videoID uuid.UUID, rawURL *string, expires time.Time) *string {
+	if rawURL == nil {
+		return nil
+	}
+	signed, err := cfg.urlSigner.SignURL(*rawURL, expires)
+	if err != nil {
+		log.Printf("Couldn't sign URL for video %s: %v", videoID, err)
+		return nil
+	}
+	return &signed
+}
+
+// objectKey returns the storage key for a value from the videos table. The
+// media columns hold keys; anything that looks like a URL is one
+// migrateMediaKeys couldn't make sense of and is passed through as it is.
+func (cfg *apiConfig) objectKey(stored string) (string, bool) {
+	if stored == "" || strings.Contains(stored, "://") {
+		return "", false
+	}
+	return stored, true
+}
+
+// canView reports whether the caller may see the video. Private videos are
+// only visible to their owner; everything else to anyone with the ID.
+func (cfg *apiConfig) canView(r *http.Request, video database.Video) bool {
+	if video.Visibility != database.VisibilityPrivate {
+		return true
+	}
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		return false
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		return false
+	}
+	return userID == video.UserID
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Events published while a video goes from upload to ready. Transcoding
+// events carry a percentage and the stage they're about ("mp4", an HLS
+// rendition such as "720p", "trim", "sprites", "preview", "audio" or
+// "waveform").
+const (
+	videoEventUploadReceived = "upload-received"
+	videoEventProbing        = "probing"
+	videoEventQueued         = "queued"
+	videoEventProcessing     = "processing"
+	videoEventTranscoding    = "transcoding"
+	videoEventUploading      = "uploading"
+	videoEventRetrying       = "retrying"
+	videoEventDone           = "done"
+	videoEventFailed         = "failed"
+)
+
+type videoEvent struct {
+	Type    string    `json:"type"`
+	Stage   string    `json:"stage,omitempty"`
+	Percent *float64  `json:"percent,omitempty"`
+	Error   string    `json:"error,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+func (e videoEvent) terminal() bool {
+	return e.Type == videoEventDone || e.Type == videoEventFailed
+}
+
+// videoEventBus fans processing events out to whoever is watching a video.
+// It's in-process only: events aren't stored, and a subscriber that falls
+// behind misses events rather than holding up the pipeline.
+type videoEventBus struct {
+	mu          sync.Mutex
+	subscribers map[uuid.UUID]map[chan videoEvent]struct{}
+	// latest is the last event of every video that's still in flight, so
+	// that late subscribers learn where things stand.
+	latest map[uuid.UUID]videoEvent
+}
+
+func newVideoEventBus() *videoEventBus {
+	return &videoEventBus{
+		subscribers: map[uuid.UUID]map[chan videoEvent]struct{}{},
+		latest:      map[uuid.UUID]videoEvent{},
+	}
+}
+
+// subscribe returns a channel of the video's events, starting with the
+// latest one if it's in flight, and a function to stop the subscription.
+func (b *videoEventBus) subscribe(videoID uuid.UUID) (<-chan videoEvent, func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	events := make(chan videoEvent, 16)
+	if latest, ok := b.latest[videoID]; ok {
+		events <- latest
+	}
+	if b.subscribers[videoID] == nil {
+		b.subscribers[videoID] = map[chan videoEvent]struct{}{}
+	}
+	b.subscribers[videoID][events] = struct{}{}
+
+	return events, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.subscribers[videoID], events)
+		if len(b.subscribers[videoID]) == 0 {
+			delete(b.subscribers, videoID)
+		}
+	}
+}
+
+func (b *videoEventBus) publish(videoID uuid.UUID, event videoEvent) {
+	event.Time = time.Now().UTC()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if event.terminal() {
+		delete(b.latest, videoID)
+	} else {
+		b.latest[videoID] = event
+	}
+	for events := range b.subscribers[videoID] {
+		select {
+		case events <- event:
+		default:
+		}
+	}
+}
+
+// progressPublisher returns a callback for runFFmpeg that publishes
+// transcoding events for stage, at most one per whole percent.
+func (b *videoEventBus) progressPublisher(videoID uuid.UUID, stage string) func(float64) {
+	last := -1
+	return func(percent float64) {
+		if int(percent) == last {
+			return
+		}
+		last = int(percent)
+		b.publish(videoID, videoEvent{Type: videoEventTranscoding, Stage: stage, Percent: &percent})
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+)
+
+type videoFormat struct {
+	name      string
+	mediaType string
+}
+
+// videoFormats are the containers we know how to recognise. Which of them
+// are accepted is up to cfg.allowedVideoFormats.
+var videoFormats = []videoFormat{
+	{"mp4", "video/mp4"},
+	{"mov", "video/quicktime"},
+	{"webm", "video/webm"},
+	{"mkv", "video/x-matroska"},
+}
+
+func videoFormatByName(name string) (videoFormat, bool) {
+	for _, format := range videoFormats {
+		if format.name == name {
+			return format, true
+		}
+	}
+	return videoFormat{}, false
+}
+
+func videoFormatByMediaType(mediaType string) (videoFormat, bool) {
+	for _, format := range videoFormats {
+		if format.mediaType == mediaType {
+			return format, true
+		}
+	}
+	return videoFormat{}, false
+}
+
+// checkDeclaredMediaType validates the type a client says it's about to
+// upload, so obviously wrong files are turned away before any bytes are
+// sent. The bytes themselves are sniffed again once they arrive.
+func (cfg *apiConfig) checkDeclaredMediaType(mediaType string) error {
+	format, ok := videoFormatByMediaType(mediaType)
+	if !ok || !slices.Contains(cfg.allowedVideoFormats, format.name) {
+		return fmt.Errorf("%w: %s uploads aren't accepted", errUnsupportedVideo, mediaType)
+	}
+	return nil
+}
+
+// sniffVideoFile identifies the container from the file's leading bytes and
+// checks it against the allow-list.
+func (cfg *apiConfig) sniffVideoFile(filePath string) (videoFormat, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return videoFormat{}, err
+	}
+	defer file.Close()
+
+	header := make([]byte, 512)
+	n, err := io.ReadFull(file, header)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return videoFormat{}, fmt.Errorf("%w: file is empty", errUnsupportedVideo)
+	}
+
+	name := sniffVideoFormat(header[:n])
+	if name == "" {
+		return videoFormat{}, fmt.Errorf("%w: unrecognised file format", errUnsupportedVideo)
+	}
+	format, _ := videoFormatByName(name)
+	if !slices.Contains(cfg.allowedVideoFormats, name) {
+		return videoFormat{}, fmt.Errorf("%w: %s files aren't accepted", errUnsupportedVideo, name)
+	}
+	return format, nil
+}
+
+var ebmlMagic = []byte{0x1a, 0x45, 0xdf, 0xa3}
+
+// sniffVideoFormat returns the name of the container in header, or "" if
+// it isn't one we know.
+func sniffVideoFormat(header []byte) string {
+	if bytes.HasPrefix(header, ebmlMagic) {
+		// WebM is a Matroska subset; the EBML header's DocType tells them
+		// apart.
+		if bytes.Contains(header, []byte("webm")) {
+			return "webm"
+		}
+		if bytes.Contains(header, []byte("matroska")) {
+			return "mkv"
+		}
+		return ""
+	}
+
+	if len(header) < 12 {
+		return ""
+	}
+	boxType := string(header[4:8])
+	switch boxType {
+	case "ftyp":
+		majorBrand := string(header[8:12])
+		if majorBrand == "qt  " {
+			return "mov"
+		}
+		if strings.HasPrefix(majorBrand, "3g") {
+			return ""
+		}
+		return "mp4"
+	case "moov", "mdat", "wide", "free", "skip", "pnot":
+		// QuickTime files from before ftyp existed start straight with a
+		// movie or media box.
+		return "mov"
+	}
+	return ""
+}
+
+// transcodeToMP4 re-encodes any input ffmpeg can read to H.264/AAC in an MP4
+// container, which every browser can play.
+func transcodeToMP4(ctx context.Context, filePath string, duration float64, progress func(float64)) (string, error) {
+	outputPath := filePath + ".transcoded.mp4"
+	err := runFFmpeg(ctx, []string{
+		"-y",
+		"-i", filePath,
+		"-map", "0:v:0",
+		"-map", "0:a:0?",
+		"-c:v", "libx264",
+		"-preset", "medium",
+		"-crf", "20",
+		"-pix_fmt", "yuv420p",
+		"-c:a", "aac",
+		"-b:a", "160k",
+		"-f", "mp4",
+		outputPath,
+	}, duration, progress)
+	if err != nil {
+		os.Remove(outputPath)
+		return "", err
+	}
+	return outputPath, nil
+}
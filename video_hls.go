@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+	"github.com/google/uuid"
+)
+
+const hlsMasterPlaylist = "master.m3u8"
+
+// hlsLadder lists the renditions we package, largest first. Size is the
+// height of landscape video and the width of portrait video, so a phone
+// recording gets the same ladder turned on its side.
+var hlsLadder = []struct {
+	size         int
+	videoBitrate int // kbit/s
+}{
+	{1080, 5000},
+	{720, 2800},
+	{480, 1400},
+	{360, 800},
+}
+
+const hlsAudioBitrate = 128 // kbit/s
+
+// h264Levels are the limits of the H.264 levels (table A-1 of the spec) the
+// renditions can need: macroblocks per second, macroblocks per frame and
+// the Main profile's bitrate in kbit/s.
+var h264Levels = []struct {
+	idc      int
+	mbPerSec int
+	mbPerFrm int
+	bitrate  int
+}{
+	{21, 19800, 792, 4800},
+	{22, 20250, 1620, 4800},
+	{30, 40500, 1620, 12000},
+	{31, 108000, 3600, 16800},
+	{32, 216000, 5120, 24000},
+	{40, 245760, 8192, 24000},
+	{41, 245760, 8192, 60000},
+	{42, 522240, 8704, 60000},
+	{50, 589824, 22080, 162000},
+	{51, 983040, 36864, 288000},
+	{52, 2073600, 36864, 288000},
+}
+
+// hlsUnknownFrameRate stands in for a frame rate ffprobe didn't report, high
+// enough that the level is never understated.
+const hlsUnknownFrameRate = 60
+
+type hlsRendition struct {
+	name         string
+	width        int
+	height       int
+	videoBitrate int
+	// level is the H.264 level_idc, 31 for level 3.1.
+	level int
+}
+
+func (r hlsRendition) bandwidth() int {
+	return (r.videoBitrate + hlsAudioBitrate) * 1000
+}
+
+// hlsRenditions picks the ladder rungs that fit in the source, never
+// upscaling. A source smaller than the lowest rung gets a single rendition
+// at its own size.
+func hlsRenditions(width, height int, aspectRatio string, frameRate float64) []hlsRendition {
+	portrait := aspectRatio == "portrait" || (aspectRatio == "other" && height > width)
+	sourceSize := height
+	if portrait {
+		sourceSize = width
+	}
+
+	renditions := []hlsRendition{}
+	for _, rung := range hlsLadder {
+		if rung.size > sourceSize {
+			continue
+		}
+		renditions = append(renditions, newHLSRendition(width, height, rung.size, rung.videoBitrate, portrait))
+	}
+	if len(renditions) == 0 {
+		lowest := hlsLadder[len(hlsLadder)-1]
+		renditions = append(renditions, newHLSRendition(width, height, sourceSize, lowest.videoBitrate, portrait))
+	}
+	if frameRate <= 0 {
+		frameRate = hlsUnknownFrameRate
+	}
+	for i := range renditions {
+		renditions[i].level = renditions[i].h264Level(frameRate)
+	}
+	return renditions
+}
+
+// h264Level is the lowest level that fits the rendition at frameRate and
+// its peak bitrate.
+func (r hlsRendition) h264Level(frameRate float64) int {
+	mbPerFrame := ((r.width + 15) / 16) * ((r.height + 15) / 16)
+	mbPerSec := int(math.Ceil(float64(mbPerFrame) * frameRate))
+	for _, level := range h264Levels {
+		if mbPerFrame <= level.mbPerFrm && mbPerSec <= level.mbPerSec && r.maxrate() <= level.bitrate {
+			return level.idc
+		}
+	}
+	return h264Levels[len(h264Levels)-1].idc
+}
+
+func (r hlsRendition) maxrate() int {
+	return r.videoBitrate * 107 / 100
+}
+
+// codecs is the rendition's RFC 6381 CODECS attribute: H.264 Main at its
+// level, and AAC-LC when there's audio.
+func (r hlsRendition) codecs(hasAudio bool) string {
+	codecs := fmt.Sprintf("avc1.4d40%02x", r.level)
+	if hasAudio {
+		codecs += ",mp4a.40.2"
+	}
+	return codecs
+}
+
+func newHLSRendition(sourceWidth, sourceHeight, size, videoBitrate int, portrait bool) hlsRendition {
+	r := hlsRendition{
+		name:         fmt.Sprintf("%dp", size),
+		videoBitrate: videoBitrate,
+	}
+	// libx264 needs even dimensions.
+	if portrait {
+		r.width = evenFloor(size)
+		r.height = evenFloor(sourceHeight * size / sourceWidth)
+	} else {
+		r.height = evenFloor(size)
+		r.width = evenFloor(sourceWidth * size / sourceHeight)
+	}
+	return r
+}
+
+func evenFloor(n int) int {
+	return n - n%2
+}
+
+// packageHLS transcodes the video into the rendition ladder, uploads the
+// segments and playlists under prefix and returns the master playlist key.
+// Progress is published as events of videoID.
+func (cfg *apiConfig) packageHLS(ctx context.Context, videoID uuid.UUID, videoPath, prefix string, width, height int, aspectRatio string, probe mediaProbe) (string, error) {
+	outputDir, err := os.MkdirTemp("", "tubely-hls-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(outputDir)
+
+	renditions := hlsRenditions(width, height, aspectRatio, probe.FrameRate)
+	for _, rendition := range renditions {
+		err := transcodeHLSRendition(ctx, videoPath, outputDir, rendition, probe.Duration, cfg.events.progressPublisher(videoID, rendition.name))
+		if err != nil {
+			return "", fmt.Errorf("rendition %s: %w", rendition.name, err)
+		}
+	}
+
+	err = os.WriteFile(filepath.Join(outputDir, hlsMasterPlaylist), []byte(buildHLSMasterPlaylist(renditions, probe.AudioCodec != "")), 0644)
+	if err != nil {
+		return "", err
+	}
+
+	cfg.events.publish(videoID, videoEvent{Type: videoEventUploading, Stage: "hls"})
+	err = cfg.putDir(ctx, outputDir, prefix)
+	if err != nil {
+		return "", err
+	}
+	return prefix + hlsMasterPlaylist, nil
+}
+
+func transcodeHLSRendition(ctx context.Context, videoPath, outputDir string, rendition hlsRendition, duration float64, progress func(float64)) error {
+	return runFFmpeg(ctx, []string{
+		"-y",
+		"-i", videoPath,
+		"-vf", fmt.Sprintf("scale=%d:%d", rendition.width, rendition.height),
+		"-c:v", "libx264",
+		"-preset", "veryfast",
+		"-profile:v", "main",
+		"-level:v", fmt.Sprintf("%d.%d", rendition.level/10, rendition.level%10),
+		"-b:v", fmt.Sprintf("%dk", rendition.videoBitrate),
+		"-maxrate", fmt.Sprintf("%dk", rendition.maxrate()),
+		"-bufsize", fmt.Sprintf("%dk", rendition.videoBitrate*3/2),
+		// Keyframes every 2s so segments of every rendition line up.
+		"-sc_threshold", "0",
+		"-force_key_frames", "expr:gte(t,n_forced*2)",
+		"-c:a", "aac",
+		"-b:a", fmt.Sprintf("%dk", hlsAudioBitrate),
+		"-ac", "2",
+		"-f", "hls",
+		"-hls_time", "6",
+		"-hls_playlist_type", "vod",
+		"-hls_segment_filename", filepath.Join(outputDir, rendition.name+"_%04d.ts"),
+		filepath.Join(outputDir, rendition.name+".m3u8"),
+	}, duration, progress)
+}
+
+func buildHLSMasterPlaylist(renditions []hlsRendition, hasAudio bool) string {
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	b.WriteString("#EXT-X-VERSION:3\n")
+	for _, r := range renditions {
+		fmt.Fprintf(&b, "#EXT-X-STREAM-INF:BANDWIDTH=%d,RESOLUTION=%dx%d,CODECS=\"%s\"\n", r.bandwidth(), r.width, r.height, r.codecs(hasAudio))
+		b.WriteString(r.name + ".m3u8\n")
+	}
+	return b.String()
+}
+
+// putDir uploads every file in dir to storage under prefix.
+func (cfg *apiConfig) putDir(ctx context.Context, dir, prefix string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		err := cfg.putFile(ctx, filepath.Join(dir, entry.Name()), prefix+entry.Name(), contentTypeForFile(entry.Name()))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (cfg *apiConfig) putFile(ctx context.Context, filePath, key, contentType string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return cfg.storage.Put(ctx, key, file, storage.PutOptions{ContentType: contentType})
+}
+
+func contentTypeForFile(name string) string {
+	switch filepath.Ext(name) {
+	case ".m4a":
+		return "audio/mp4"
+	case ".mp3":
+		return "audio/mpeg"
+	case ".json":
+		return "application/json"
+	case ".vtt":
+		return "text/vtt"
+	case ".m3u8":
+		return "application/vnd.apple.mpegurl"
+	case ".ts":
+		return "video/mp2t"
+	case ".mp4":
+		return "video/mp4"
+	case ".jpg", ".jpeg":
+		return "image/jpeg"
+	case ".png":
+		return "image/png"
+	}
+	return "application/octet-stream"
+}
+
+// lastLines keeps ffmpeg error output short enough for a log line.
+func lastLines(s string, n int) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, " | ")
+}
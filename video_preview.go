@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+const (
+	previewFile = "preview.mp4"
+	// previewSize is the longer side of the preview, it's shown on video
+	// cards rather than played.
+	previewSize = 320
+)
+
+type previewSegment struct {
+	start  float64
+	length float64
+}
+
+// previewClip picks the parts of a video of duration seconds that make
+// up its preview. With a single segment it's cfg.previewDuration from
+// cfg.previewStart on; with more, the preview is split into that many equal
+// segments, each from the middle of an equal slice of the video, so it
+// shows a bit of everything. Videos shorter than the preview are used whole.
+func (cfg *apiConfig) previewClip(duration float64) []previewSegment {
+	if cfg.previewDuration <= 0 || duration <= 0 {
+		return nil
+	}
+	total := min(cfg.previewDuration.Seconds(), duration)
+	if cfg.previewSegments <= 1 {
+		start := max(0, min(cfg.previewStart.Seconds(), duration-total))
+		return []previewSegment{{start: start, length: total}}
+	}
+
+	segments := make([]previewSegment, cfg.previewSegments)
+	slice := duration / float64(cfg.previewSegments)
+	length := total / float64(cfg.previewSegments)
+	for i := range segments {
+		segments[i] = previewSegment{
+			start:  float64(i)*slice + (slice-length)/2,
+			length: length,
+		}
+	}
+	return segments
+}
+
+// previewDimensions scales width x height down so the longer side is
+// previewSize, keeping both even for libx264.
+func previewDimensions(width, height int) (int, int) {
+	if width >= height {
+		size := min(previewSize, width)
+		return max(2, evenFloor(size)), max(2, evenFloor(height*size/width))
+	}
+	size := min(previewSize, height)
+	return max(2, evenFloor(width*size/height)), max(2, evenFloor(size))
+}
+
+// generatePreview cuts a short, muted, low resolution clip out of the
+// video for hover previews (see previewClip), uploads it under prefix
+// and returns its key. Videos of unknown duration get no preview, nor do
+// any with previews turned off.
+func (cfg *apiConfig) generatePreview(ctx context.Context, videoID uuid.UUID, videoPath, prefix string, width, height int, duration float64) (*string, error) {
+	segments := cfg.previewClip(duration)
+	if len(segments) == 0 || width <= 0 || height <= 0 {
+		return nil, nil
+	}
+	outputDir, err := os.MkdirTemp("", "tubely-preview-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(outputDir)
+
+	previewWidth, previewHeight := previewDimensions(width, height)
+	var filter strings.Builder
+	var total float64
+	for i, segment := range segments {
+		fmt.Fprintf(&filter, "[0:v]trim=start=%.3f:duration=%.3f,setpts=PTS-STARTPTS[v%d];", segment.start, segment.length, i)
+		total += segment.length
+	}
+	for i := range segments {
+		fmt.Fprintf(&filter, "[v%d]", i)
+	}
+	fmt.Fprintf(&filter, "concat=n=%d:v=1:a=0,scale=%d:%d,format=yuv420p[out]", len(segments), previewWidth, previewHeight)
+
+	outputPath := filepath.Join(outputDir, previewFile)
+	err = runFFmpeg(ctx, []string{
+		"-y",
+		"-i", videoPath,
+		"-filter_complex", filter.String(),
+		"-map", "[out]",
+		"-an",
+		"-c:v", "libx264",
+		"-preset", "veryfast",
+		"-crf", "28",
+		"-movflags", "faststart",
+		outputPath,
+	}, total, cfg.events.progressPublisher(videoID, "preview"))
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.events.publish(videoID, videoEvent{Type: videoEventUploading, Stage: "preview"})
+	key := prefix + previewFile
+	err = cfg.putFile(ctx, outputPath, key, "video/mp4")
+	if err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+type ffprobeOutput struct {
+	Streams []struct {
+		CodecType    string            `json:"codec_type"`
+		CodecName    string            `json:"codec_name"`
+		Width        int               `json:"width"`
+		Height       int               `json:"height"`
+		AvgFrameRate string            `json:"avg_frame_rate"`
+		RFrameRate   string            `json:"r_frame_rate"`
+		Tags         map[string]string `json:"tags"`
+		SideDataList []ffprobeSideData `json:"side_data_list"`
+		Disposition  struct {
+			AttachedPic int `json:"attached_pic"`
+		} `json:"disposition"`
+	} `json:"streams"`
+	Format struct {
+		FormatName string `json:"format_name"`
+		Duration   string `json:"duration"`
+		BitRate    string `json:"bit_rate"`
+	} `json:"format"`
+}
+
+type ffprobeSideData struct {
+	Rotation *float64 `json:"rotation"`
+}
+
+// mediaProbe is what we keep from ffprobe about an uploaded file.
+type mediaProbe struct {
+	Duration   float64
+	Container  string
+	VideoCodec string
+	AudioCodec string
+	Bitrate    int64
+	FrameRate  float64
+	Rotation   int
+	Width      int
+	Height     int
+}
+
+var errNoVideoStream = errors.New("no video stream found")
+
+func probeMedia(ctx context.Context, filePath string) (mediaProbe, error) {
+	cmd := exec.CommandContext(ctx, "ffprobe", "-v", "error", "-print_format", "json", "-show_streams", "-show_format", filePath)
+	var stdout bytes.Buffer
+	var stderr strings.Builder
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		return mediaProbe{}, fmt.Errorf("ffprobe: %w: %s", err, lastLines(stderr.String(), 3))
+	}
+
+	var output ffprobeOutput
+	err = json.Unmarshal(stdout.Bytes(), &output)
+	if err != nil {
+		return mediaProbe{}, err
+	}
+
+	probe := mediaProbe{
+		Container: output.Format.FormatName,
+	}
+	probe.Duration, _ = strconv.ParseFloat(output.Format.Duration, 64)
+	probe.Bitrate, _ = strconv.ParseInt(output.Format.BitRate, 10, 64)
+
+	foundVideo := false
+	for _, stream := range output.Streams {
+		switch stream.CodecType {
+		case "video":
+			// Cover art in audio files shows up as a single frame video stream.
+			if foundVideo || stream.Disposition.AttachedPic == 1 {
+				continue
+			}
+			foundVideo = true
+			probe.VideoCodec = stream.CodecName
+			probe.Width = stream.Width
+			probe.Height = stream.Height
+			probe.FrameRate = parseFrameRate(stream.AvgFrameRate)
+			if probe.FrameRate == 0 {
+				probe.FrameRate = parseFrameRate(stream.RFrameRate)
+			}
+			probe.Rotation = streamRotation(stream.Tags, stream.SideDataList)
+		case "audio":
+			if probe.AudioCodec == "" {
+				probe.AudioCodec = stream.CodecName
+			}
+		}
+	}
+
+	if !foundVideo {
+		return probe, errNoVideoStream
+	}
+	if probe.Width == 0 || probe.Height == 0 {
+		return probe, fmt.Errorf("invalid video dimensions")
+	}
+	return probe, nil
+}
+
+// displayDimensions accounts for rotation metadata: phones often record
+// portrait video as landscape frames tagged with a 90 degree rotation, and
+// ffmpeg applies it when transcoding.
+func (p mediaProbe) displayDimensions() (int, int) {
+	if p.Rotation%180 != 0 {
+		return p.Height, p.Width
+	}
+	return p.Width, p.Height
+}
+
+func (p mediaProbe) metadata() database.VideoMetadata {
+	metadata := database.VideoMetadata{
+		DurationSeconds: &p.Duration,
+		Container:       &p.Container,
+		VideoCodec:      &p.VideoCodec,
+		Bitrate:         &p.Bitrate,
+		FrameRate:       &p.FrameRate,
+		Rotation:        &p.Rotation,
+		Width:           &p.Width,
+		Height:          &p.Height,
+	}
+	if p.AudioCodec != "" {
+		metadata.AudioCodec = &p.AudioCodec
+	}
+	return metadata
+}
+
+var errUnsupportedVideo = errors.New("unsupported video")
+
+// validateCodecs rejects files the pipeline can't turn into a playable MP4.
+func (cfg *apiConfig) validateCodecs(probe mediaProbe) error {
+	if !slices.Contains(cfg.allowedVideoCodecs, probe.VideoCodec) {
+		return fmt.Errorf("%w: video codec %q isn't supported", errUnsupportedVideo, probe.VideoCodec)
+	}
+	if probe.AudioCodec != "" && !slices.Contains(cfg.allowedAudioCodecs, probe.AudioCodec) {
+		return fmt.Errorf("%w: audio codec %q isn't supported", errUnsupportedVideo, probe.AudioCodec)
+	}
+	return nil
+}
+
+// parseFrameRate parses ffprobe's rational frame rates such as "30000/1001".
+func parseFrameRate(rate string) float64 {
+	num, den, found := strings.Cut(rate, "/")
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil {
+		return 0
+	}
+	if !found {
+		return n
+	}
+	d, err := strconv.ParseFloat(den, 64)
+	if err != nil || d == 0 {
+		return 0
+	}
+	return n / d
+}
+
+// streamRotation returns the clockwise rotation in degrees, normalised to
+// 0, 90, 180 or 270. Older files carry it as a tag, newer ffprobe versions
+// report it in the display matrix side data (counter-clockwise).
+func streamRotation(tags map[string]string, sideData []ffprobeSideData) int {
+	rotation := 0
+	if rotate, ok := tags["rotate"]; ok {
+		rotation, _ = strconv.Atoi(rotate)
+	}
+	for _, data := range sideData {
+		if data.Rotation != nil {
+			rotation = -int(*data.Rotation)
+		}
+	}
+	rotation %= 360
+	if rotation < 0 {
+		rotation += 360
+	}
+	return rotation
+}
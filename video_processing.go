@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"os/exec"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+	"github.com/google/uuid"
+)
+
+// processVideo runs an uploaded file through ffprobe and the faststart remux,
+// stores the result and points the video record at it. Anything that isn't
+// already an MP4 is transcoded to H.264/AAC first, so every video ends up
+// stored as video/mp4. If the same file (by sourceSHA256) has been processed
+// before, the stored result is shared instead. If the owner's videos get a
+// watermark it's burned in while transcoding, and the upload is kept as the
+// original to process again when the watermark changes. It's called by the
+// processing queue workers, not from request handlers.
+func (cfg *apiConfig) processVideo(ctx context.Context, video database.Video, sourcePath, mediaType, sourceSHA256 string) (database.Video, error) {
+	watermark, err := cfg.watermarkFor(video.UserID)
+	if err != nil {
+		return video, err
+	}
+	var originalKey *string
+	// Until it's handed to attachVideoBlob, the original is ours to let go.
+	defer func() {
+		cfg.releaseMedia(cfg.mediaRelease(originalKey))
+	}()
+	attach := func(blob database.Blob, thumbnailSource string) (database.Video, error) {
+		kept := originalKey
+		originalKey = nil
+		return cfg.attachVideoBlob(ctx, video.ID, blob, kept, thumbnailSource)
+	}
+	if watermark != nil {
+		if sourceSHA256 == "" {
+			sourceSHA256, err = hashFile(sourcePath)
+			if err != nil {
+				return video, fmt.Errorf("couldn't hash video: %w", err)
+			}
+		}
+		key, err := cfg.keepOriginal(ctx, video.ID, sourcePath, sourceSHA256)
+		if err != nil {
+			return video, err
+		}
+		originalKey = &key
+		sourceSHA256 = watermarkedSourceSHA256(sourceSHA256, *watermark)
+	}
+
+	if sourceSHA256 != "" {
+		blob, err := cfg.db.ReuseBlob(database.BlobKindVideo, sourceSHA256)
+		if err != nil {
+			return video, fmt.Errorf("couldn't look up blob: %w", err)
+		}
+		if blob.Key != "" {
+			return attach(blob, sourcePath)
+		}
+	}
+
+	probe, err := probeMedia(ctx, sourcePath)
+	if err != nil {
+		return video, fmt.Errorf("couldn't probe video: %w", err)
+	}
+	width, height := probe.displayDimensions()
+	videoAspectRatio := aspectRatioName(width, height)
+
+	mp4Path := sourcePath
+	switch {
+	case watermark != nil:
+		mp4Path, err = cfg.burnWatermark(ctx, video.ID, sourcePath, *watermark, width, height, probe.Duration)
+		if err != nil {
+			return video, fmt.Errorf("couldn't burn in watermark: %w", err)
+		}
+		err = cfg.claimUpload(mp4Path)
+		if err != nil {
+			return video, err
+		}
+		defer cfg.removeUpload(mp4Path)
+	case mediaType != "video/mp4":
+		mp4Path, err = transcodeToMP4(ctx, sourcePath, probe.Duration, cfg.events.progressPublisher(video.ID, "mp4"))
+		if err != nil {
+			return video, fmt.Errorf("couldn't transcode %s to mp4: %w", mediaType, err)
+		}
+		err = cfg.claimUpload(mp4Path)
+		if err != nil {
+			return video, err
+		}
+		defer cfg.removeUpload(mp4Path)
+	}
+
+	fastVideoPath, err := processVideoForFastStart(mp4Path)
+	if err != nil {
+		return video, fmt.Errorf("couldn't process video: %w", err)
+	}
+	err = cfg.claimUpload(fastVideoPath)
+	if err != nil {
+		return video, err
+	}
+	defer cfg.removeUpload(fastVideoPath)
+	fastVideofile, err := os.Open(fastVideoPath)
+	if err != nil {
+		return video, fmt.Errorf("couldn't open processed video: %w", err)
+	}
+	defer fastVideofile.Close()
+	fastVideoInfo, err := fastVideofile.Stat()
+	if err != nil {
+		return video, fmt.Errorf("couldn't stat processed video: %w", err)
+	}
+	fastVideoSum, err := hashFile(fastVideoPath)
+	if err != nil {
+		return video, fmt.Errorf("couldn't hash processed video: %w", err)
+	}
+	checksum, err := sha256Checksum(fastVideoSum)
+	if err != nil {
+		return video, err
+	}
+
+	randomBytes := make([]byte, 32)
+	_, err = rand.Read(randomBytes)
+	if err != nil {
+		return video, fmt.Errorf("error creating random filename: %w", err)
+	}
+	hexString := hex.EncodeToString(randomBytes)
+	filename := videoAspectRatio + "/" + hexString + ".mp4"
+	cfg.events.publish(video.ID, videoEvent{Type: videoEventUploading, Stage: "mp4"})
+	err = cfg.storage.Put(ctx, filename, fastVideofile, storage.PutOptions{
+		ContentType: "video/mp4",
+		Checksum:    checksum,
+	})
+	if err != nil {
+		return video, fmt.Errorf("couldn't upload video: %w", err)
+	}
+	// Until a blob owns the new media, it's ours to clean up.
+	owned := true
+	defer func() {
+		if owned {
+			cfg.releaseMedia(cfg.videoMediaRelease(&filename))
+		}
+	}()
+
+	blob := database.Blob{CreateBlobParams: database.CreateBlobParams{
+		Kind:           database.BlobKindVideo,
+		SHA256:         sourceSHA256,
+		Key:            filename,
+		Size:           fastVideoInfo.Size(),
+		ChecksumSHA256: &checksum.Value,
+	}}
+	if watermark != nil {
+		fingerprint := watermark.fingerprint()
+		blob.Watermark = &fingerprint
+	}
+	if cfg.hlsEnabled {
+		hlsPrefix := videoMediaPrefix(filename) + "hls/"
+		hlsKey, err := cfg.packageHLS(ctx, video.ID, fastVideoPath, hlsPrefix, width, height, videoAspectRatio, probe)
+		if err != nil {
+			return video, fmt.Errorf("couldn't package HLS renditions: %w", err)
+		}
+		blob.HLSKey = &hlsKey
+	}
+	blob.ThumbnailTrackKey, blob.SpriteSheets, err = cfg.generateSprites(ctx, video.ID, fastVideoPath, videoMediaPrefix(filename)+"sprites/", width, height, probe.Duration)
+	if err != nil {
+		return video, fmt.Errorf("couldn't generate sprite sheets: %w", err)
+	}
+	blob.PreviewKey, err = cfg.generatePreview(ctx, video.ID, fastVideoPath, videoMediaPrefix(filename), width, height, probe.Duration)
+	if err != nil {
+		return video, fmt.Errorf("couldn't generate preview: %w", err)
+	}
+	blob.AudioKey, blob.WaveformKey, err = cfg.generateAudio(ctx, video.ID, fastVideoPath, videoMediaPrefix(filename), probe)
+	if err != nil {
+		return video, err
+	}
+
+	// Jobs queued before uploads were hashed have nothing to share by.
+	if sourceSHA256 != "" {
+		blob, err = cfg.db.AcquireBlob(blob.CreateBlobParams)
+		if err != nil {
+			return video, fmt.Errorf("couldn't register blob: %w", err)
+		}
+		// The same file was processed by someone else in the meantime, keep
+		// theirs and let ours go.
+		if blob.Key != filename {
+			return attach(blob, fastVideoPath)
+		}
+	}
+	owned = false
+	return attach(blob, fastVideoPath)
+}
+
+// attachVideoBlob points the video at blob and originalKey, whose
+// references the caller holds, and releases what it pointed at before. If
+// the video can't be updated the references are given back. A thumbnail is
+// generated from thumbnailSource if the video doesn't have one yet.
+func (cfg *apiConfig) attachVideoBlob(ctx context.Context, videoID uuid.UUID, blob database.Blob, originalKey *string, thumbnailSource string) (database.Video, error) {
+	videoKey := blob.Key
+	attached := false
+	defer func() {
+		if !attached {
+			cfg.releaseMedia(cfg.videoMediaRelease(&videoKey))
+			cfg.releaseMedia(cfg.mediaRelease(originalKey))
+		}
+	}()
+
+	// Processing can take a while, don't overwrite changes made meanwhile.
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		return video, fmt.Errorf("couldn't get video: %w", err)
+	}
+	if video.ID == uuid.Nil {
+		return video, fmt.Errorf("%w: video was deleted while processing", errJobNotRetryable)
+	}
+	released := cfg.videoMediaRelease(video.VideoURL)
+	released = append(released, cfg.mediaRelease(video.OriginalKey)...)
+	video.VideoURL = &videoKey
+	video.OriginalKey = originalKey
+	video.Watermark = blob.Watermark
+	video.HLSURL = blob.HLSKey
+	video.ThumbnailTrackURL = blob.ThumbnailTrackKey
+	video.SpriteSheets = blob.SpriteSheets
+	video.PreviewURL = blob.PreviewKey
+	video.AudioURL = blob.AudioKey
+	video.WaveformURL = blob.WaveformKey
+	video.VideoChecksumSHA256 = blob.ChecksumSHA256
+	video.ProcessingStatus = database.ProcessingStatusReady
+	video.ProcessingError = nil
+	err = cfg.db.UpdateVideoReplacingMedia(video, released)
+	if err != nil {
+		return video, fmt.Errorf("couldn't update video: %w", err)
+	}
+	attached = true
+	cfg.storageCleanup.notify()
+
+	// The new renditions need the captions added again.
+	captioned, err := cfg.publishCaptionsHLS(ctx, video)
+	if err != nil {
+		log.Printf("Couldn't add captions to the HLS playlist of video %s: %v", video.ID, err)
+	} else {
+		video = captioned
+	}
+
+	// A missing thumbnail isn't worth failing (and retrying) the whole job.
+	if video.ThumbnailURL == nil {
+		thumbnailed, err := cfg.generateThumbnail(ctx, video, thumbnailSource, cfg.thumbnailTimestamp, cfg.thumbnailMode)
+		if err != nil {
+			log.Printf("Couldn't generate thumbnail for video %s: %v", video.ID, err)
+		} else {
+			video = thumbnailed
+		}
+	}
+	return video, nil
+}
+
+func aspectRatioName(width, height int) string {
+	// Calculate aspect ratio
+	ratio := float64(width) / float64(height)
+
+	// Using tolerance for floating point comparison
+	const tolerance = 0.05
+
+	if math.Abs(ratio-16.0/9.0) < tolerance { // ~1.778
+		return "landscape"
+	} else if math.Abs(ratio-9.0/16.0) < tolerance { // ~0.5625
+		return "portrait"
+	}
+
+	return "other"
+}
+
+func processVideoForFastStart(filePath string) (string, error) {
+	outputPath := filePath + ".processing"
+	cmd := exec.Command("ffmpeg", "-y", "-i", filePath, "-c", "copy", "-movflags", "faststart", "-f", "mp4", outputPath)
+	err := cmd.Run()
+	if err != nil {
+		os.Remove(outputPath)
+		return "", err
+	}
+	return outputPath, nil
+}
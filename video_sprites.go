@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	spriteTrackFile = "thumbnails.vtt"
+	// spriteFrameWidth is the width of a single preview frame; the height
+	// follows the video's aspect ratio.
+	spriteFrameWidth = 160
+	// Frames are tiled into sheets of at most spriteColumns x spriteRows.
+	spriteColumns = 10
+	spriteRows    = 10
+)
+
+// spriteLayout is how the frames of a video are laid out on sprite sheets.
+type spriteLayout struct {
+	frames      int
+	frameWidth  int
+	frameHeight int
+	columns     int
+	rows        int
+}
+
+func newSpriteLayout(width, height int, duration float64, interval time.Duration) spriteLayout {
+	layout := spriteLayout{
+		frames:     max(1, int(math.Ceil(duration/interval.Seconds()))),
+		frameWidth: max(2, evenFloor(min(spriteFrameWidth, width))),
+	}
+	layout.frameHeight = max(2, evenFloor(height*layout.frameWidth/width))
+	// Short videos get a sheet just big enough rather than a mostly empty one.
+	layout.columns = min(spriteColumns, layout.frames)
+	layout.rows = min(spriteRows, (layout.frames+layout.columns-1)/layout.columns)
+	return layout
+}
+
+func (l spriteLayout) perSheet() int {
+	return l.columns * l.rows
+}
+
+// generateSprites samples a frame of the video every cfg.spriteInterval,
+// tiles them into sprite sheets and writes a WebVTT track whose cues point
+// at each frame's place on its sheet, for scrubbing previews. Everything is
+// uploaded under prefix; it returns the track's key and the sheets. Videos
+// of unknown duration get no sprites.
+func (cfg *apiConfig) generateSprites(ctx context.Context, videoID uuid.UUID, videoPath, prefix string, width, height int, duration float64) (*string, database.ImageVariants, error) {
+	if cfg.spriteInterval <= 0 || duration <= 0 || width <= 0 || height <= 0 {
+		return nil, nil, nil
+	}
+	outputDir, err := os.MkdirTemp("", "tubely-sprites-")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer os.RemoveAll(outputDir)
+
+	layout := newSpriteLayout(width, height, duration, cfg.spriteInterval)
+	err = runFFmpeg(ctx, []string{
+		"-y",
+		"-i", videoPath,
+		"-an",
+		"-vf", fmt.Sprintf("fps=1000/%d,scale=%d:%d,tile=%dx%d",
+			cfg.spriteInterval.Milliseconds(), layout.frameWidth, layout.frameHeight, layout.columns, layout.rows),
+		"-q:v", "5",
+		filepath.Join(outputDir, "sprite_%03d.jpg"),
+	}, duration, cfg.events.progressPublisher(videoID, "sprites"))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// ffmpeg's frame count can be off by one from ours at the very end, so
+	// go by the sheets it actually wrote.
+	sheets := database.ImageVariants{}
+	for i := 0; i*layout.perSheet() < layout.frames; i++ {
+		name := fmt.Sprintf("sprite_%03d.jpg", i+1)
+		_, err := os.Stat(filepath.Join(outputDir, name))
+		if err != nil {
+			break
+		}
+		sheets = append(sheets, database.ImageVariant{
+			Width:  layout.columns * layout.frameWidth,
+			Height: layout.rows * layout.frameHeight,
+			URL:    prefix + name,
+		})
+	}
+	if len(sheets) == 0 {
+		return nil, nil, fmt.Errorf("ffmpeg didn't write any sprite sheets")
+	}
+
+	track := buildSpriteTrack(layout, sheets, cfg.spriteInterval, duration)
+	err = os.WriteFile(filepath.Join(outputDir, spriteTrackFile), []byte(track), 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cfg.events.publish(videoID, videoEvent{Type: videoEventUploading, Stage: "sprites"})
+	err = cfg.putDir(ctx, outputDir, prefix)
+	if err != nil {
+		return nil, nil, err
+	}
+	trackKey := prefix + spriteTrackFile
+	return &trackKey, sheets, nil
+}
+
+// buildSpriteTrack writes a cue for every frame, using media fragments
+// (#xywh=) to pick the frame out of its sheet. Sheets are referenced by
+// name, relative to the track.
+func buildSpriteTrack(layout spriteLayout, sheets database.ImageVariants, interval time.Duration, duration float64) string {
+	var b strings.Builder
+	b.WriteString("WEBVTT\n")
+	for frame := 0; frame < layout.frames; frame++ {
+		start := float64(frame) * interval.Seconds()
+		end := min(duration, float64(frame+1)*interval.Seconds())
+		if start >= end || frame/layout.perSheet() >= len(sheets) {
+			break
+		}
+		sheet := sheets[frame/layout.perSheet()]
+		position := frame % layout.perSheet()
+		x := position % layout.columns * layout.frameWidth
+		y := position / layout.columns * layout.frameHeight
+
+		fmt.Fprintf(&b, "\n%s --> %s\n", vttTimestamp(start), vttTimestamp(end))
+		fmt.Fprintf(&b, "%s#xywh=%d,%d,%d,%d\n", path.Base(sheet.URL), x, y, layout.frameWidth, layout.frameHeight)
+	}
+	return b.String()
+}
+
+// vttTimestamp formats seconds as a WebVTT timestamp, hh:mm:ss.ttt.
+func vttTimestamp(seconds float64) string {
+	ms := int64(math.Round(seconds * 1000))
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
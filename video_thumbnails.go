@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+)
+
+const (
+	thumbnailModeTimestamp = "timestamp"
+	thumbnailModeScene     = "scene"
+
+	// sceneChangeThreshold is how different a frame has to be from the one
+	// before it to count as a scene change, from 0 to 1.
+	sceneChangeThreshold = 0.4
+)
+
+// generateThumbnail grabs a frame from videoPath and stores it as the video's
+// thumbnail. In scene mode the first frame after a scene change is used, so
+// fade-ins and title cards are skipped; at is the fallback either way.
+func (cfg *apiConfig) generateThumbnail(ctx context.Context, video database.Video, videoPath string, at time.Duration, mode string) (database.Video, error) {
+	outputDir, err := os.MkdirTemp("", "tubely-thumbnail-")
+	if err != nil {
+		return video, err
+	}
+	defer os.RemoveAll(outputDir)
+	framePath := filepath.Join(outputDir, "frame.jpeg")
+
+	extracted := false
+	if mode == thumbnailModeScene {
+		extracted, err = extractSceneFrame(ctx, videoPath, framePath)
+		if err != nil {
+			return video, err
+		}
+	}
+	if !extracted {
+		extracted, err = extractFrameAt(ctx, videoPath, framePath, at)
+		if err != nil {
+			return video, err
+		}
+	}
+	// Asking for a frame past the end of the video gives nothing back,
+	// settle for the first frame.
+	if !extracted && at > 0 {
+		extracted, err = extractFrameAt(ctx, videoPath, framePath, 0)
+		if err != nil {
+			return video, err
+		}
+	}
+	if !extracted {
+		return video, errors.New("ffmpeg didn't produce a frame")
+	}
+
+	frame, err := os.Open(framePath)
+	if err != nil {
+		return video, err
+	}
+	defer frame.Close()
+	return cfg.storeThumbnail(ctx, video, frame, storage.Checksum{})
+}
+
+func extractFrameAt(ctx context.Context, videoPath, framePath string, at time.Duration) (bool, error) {
+	return runFrameExtraction(ctx, framePath,
+		"-ss", formatSeconds(at),
+		"-i", videoPath,
+		"-frames:v", "1",
+	)
+}
+
+func extractSceneFrame(ctx context.Context, videoPath, framePath string) (bool, error) {
+	return runFrameExtraction(ctx, framePath,
+		"-i", videoPath,
+		"-vf", fmt.Sprintf("select='gt(scene,%g)'", sceneChangeThreshold),
+		"-fps_mode", "vfr",
+		"-frames:v", "1",
+	)
+}
+
+// runFrameExtraction reports whether ffmpeg wrote a frame to framePath.
+func runFrameExtraction(ctx context.Context, framePath string, args ...string) (bool, error) {
+	os.Remove(framePath)
+	args = append([]string{"-y", "-v", "error"}, args...)
+	args = append(args, "-q:v", "2", framePath)
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		return false, fmt.Errorf("%w: %s", err, lastLines(stderr.String(), 5))
+	}
+	info, err := os.Stat(framePath)
+	if err != nil || info.Size() == 0 {
+		return false, nil
+	}
+	return true, nil
+}
+
+func formatSeconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', 3, 64)
+}
+
+// downloadToTemp copies an object to a new file in uploadsRoot named after
+// pattern, for ffmpeg. The file counts against the uploads disk budget, so
+// the caller has to remove it with removeUpload.
+func (cfg *apiConfig) downloadToTemp(ctx context.Context, key, pattern string) (string, error) {
+	body, err := cfg.storage.Get(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+
+	tempFile, err := os.CreateTemp(cfg.uploadsRoot, pattern)
+	if err != nil {
+		return "", err
+	}
+	defer tempFile.Close()
+
+	_, err = io.Copy(cfg.uploadLimits.writer(tempFile), body)
+	if err != nil {
+		cfg.removeUpload(tempFile.Name())
+		return "", err
+	}
+	return tempFile.Name(), nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	maxTrimRanges = 20
+	// minTrimLength keeps ranges from being shorter than a frame or two.
+	minTrimLength = 0.1 // seconds
+)
+
+var errInvalidTrim = errors.New("invalid trim")
+
+// checkTrimRanges validates ranges against a video of duration seconds.
+// They have to be in order and can't overlap; an end just past the end of
+// the video is taken to mean the end of the video.
+func checkTrimRanges(ranges database.TimeRanges, duration float64) (database.TimeRanges, error) {
+	if len(ranges) == 0 {
+		return nil, fmt.Errorf("%w: no ranges given", errInvalidTrim)
+	}
+	if len(ranges) > maxTrimRanges {
+		return nil, fmt.Errorf("%w: at most %d ranges are allowed", errInvalidTrim, maxTrimRanges)
+	}
+	checked := make(database.TimeRanges, len(ranges))
+	previousEnd := 0.0
+	for i, r := range ranges {
+		r.End = min(r.End, duration)
+		switch {
+		case r.Start < 0:
+			return nil, fmt.Errorf("%w: range %d starts before the video", errInvalidTrim, i+1)
+		case r.Start >= duration:
+			return nil, fmt.Errorf("%w: range %d starts after the video ends at %.3fs", errInvalidTrim, i+1, duration)
+		case r.End <= r.Start:
+			return nil, fmt.Errorf("%w: range %d ends before it starts", errInvalidTrim, i+1)
+		case r.End-r.Start < minTrimLength:
+			return nil, fmt.Errorf("%w: range %d is shorter than %.1fs", errInvalidTrim, i+1, minTrimLength)
+		case i > 0 && r.Start < previousEnd:
+			return nil, fmt.Errorf("%w: range %d overlaps or comes before the one before it", errInvalidTrim, i+1)
+		}
+		checked[i] = r
+		previousEnd = r.End
+	}
+	return checked, nil
+}
+
+// trimSourceSHA256 identifies a trim of the file that hashed to sourceSum,
+// so that the same cut of the same file is only processed once.
+func trimSourceSHA256(sourceSum string, ranges database.TimeRanges) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s trim", sourceSum)
+	for _, r := range ranges {
+		fmt.Fprintf(h, " %.3f-%.3f", r.Start, r.End)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// trimVideo cuts ranges out of the video at filePath and joins them into a
+// new H.264/AAC MP4, returning its path. Cuts are frame accurate, so the
+// video is re-encoded rather than copied.
+func (cfg *apiConfig) trimVideo(ctx context.Context, videoID uuid.UUID, filePath string, ranges database.TimeRanges) (string, error) {
+	probe, err := probeMedia(ctx, filePath)
+	if err != nil {
+		return "", err
+	}
+	hasAudio := probe.AudioCodec != ""
+
+	var filter strings.Builder
+	var total float64
+	for i, r := range ranges {
+		fmt.Fprintf(&filter, "[0:v:0]trim=start=%.3f:end=%.3f,setpts=PTS-STARTPTS[v%d];", r.Start, r.End, i)
+		if hasAudio {
+			fmt.Fprintf(&filter, "[0:a:0]atrim=start=%.3f:end=%.3f,asetpts=PTS-STARTPTS[a%d];", r.Start, r.End, i)
+		}
+		total += r.End - r.Start
+	}
+	audioStreams := 0
+	if hasAudio {
+		audioStreams = 1
+	}
+	for i := range ranges {
+		fmt.Fprintf(&filter, "[v%d]", i)
+		if hasAudio {
+			fmt.Fprintf(&filter, "[a%d]", i)
+		}
+	}
+	fmt.Fprintf(&filter, "concat=n=%d:v=1:a=%d[v]", len(ranges), audioStreams)
+	if hasAudio {
+		filter.WriteString("[a]")
+	}
+
+	args := []string{
+		"-y",
+		"-i", filePath,
+		"-filter_complex", filter.String(),
+		"-map", "[v]",
+	}
+	if hasAudio {
+		args = append(args, "-map", "[a]", "-c:a", "aac", "-b:a", "160k")
+	}
+	outputPath := filePath + ".trimmed.mp4"
+	args = append(args,
+		"-c:v", "libx264",
+		"-preset", "medium",
+		"-crf", "20",
+		"-pix_fmt", "yuv420p",
+		"-f", "mp4",
+		outputPath,
+	)
+	err = runFFmpeg(ctx, args, total, cfg.events.progressPublisher(videoID, "trim"))
+	if err != nil {
+		os.Remove(outputPath)
+		return "", err
+	}
+	return outputPath, nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func TestCheckTrimRanges(t *testing.T) {
+	tests := []struct {
+		name    string
+		ranges  database.TimeRanges
+		want    database.TimeRanges
+		wantErr bool
+	}{
+		{
+			name:   "single",
+			ranges: database.TimeRanges{{Start: 1, End: 4}},
+			want:   database.TimeRanges{{Start: 1, End: 4}},
+		},
+		{
+			name:   "several in order",
+			ranges: database.TimeRanges{{Start: 0, End: 2}, {Start: 2, End: 3}, {Start: 5, End: 9}},
+			want:   database.TimeRanges{{Start: 0, End: 2}, {Start: 2, End: 3}, {Start: 5, End: 9}},
+		},
+		{
+			name:   "end past the video is clamped",
+			ranges: database.TimeRanges{{Start: 8, End: 12}},
+			want:   database.TimeRanges{{Start: 8, End: 10}},
+		},
+		{name: "none", ranges: database.TimeRanges{}, wantErr: true},
+		{name: "negative start", ranges: database.TimeRanges{{Start: -1, End: 2}}, wantErr: true},
+		{name: "start after the end", ranges: database.TimeRanges{{Start: 10, End: 11}}, wantErr: true},
+		{name: "backwards", ranges: database.TimeRanges{{Start: 4, End: 3}}, wantErr: true},
+		{name: "too short", ranges: database.TimeRanges{{Start: 1, End: 1.05}}, wantErr: true},
+		{name: "overlapping", ranges: database.TimeRanges{{Start: 0, End: 3}, {Start: 2, End: 5}}, wantErr: true},
+		{name: "out of order", ranges: database.TimeRanges{{Start: 5, End: 6}, {Start: 1, End: 2}}, wantErr: true},
+		{name: "too many", ranges: make(database.TimeRanges, maxTrimRanges+1), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := checkTrimRanges(tt.ranges, 10)
+			if tt.wantErr {
+				if !errors.Is(err, errInvalidTrim) {
+					t.Fatalf("err = %v, want errInvalidTrim", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("range %d = %v, want %v", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestTrimSourceSHA256(t *testing.T) {
+	ranges := database.TimeRanges{{Start: 1, End: 2}}
+	if trimSourceSHA256("abc", ranges) != trimSourceSHA256("abc", database.TimeRanges{{Start: 1, End: 2}}) {
+		t.Error("same trim hashed differently")
+	}
+	if trimSourceSHA256("abc", ranges) == trimSourceSHA256("abc", database.TimeRanges{{Start: 1, End: 3}}) {
+		t.Error("different trims hashed the same")
+	}
+	if trimSourceSHA256("abc", ranges) == trimSourceSHA256("abd", ranges) {
+		t.Error("trims of different sources hashed the same")
+	}
+}
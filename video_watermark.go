@@ -0,0 +1,410 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
+	"log"
+	"math"
+	"os"
+	"slices"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+	"github.com/google/uuid"
+)
+
+const (
+	watermarkTopLeft     = "top-left"
+	watermarkTopRight    = "top-right"
+	watermarkBottomLeft  = "bottom-left"
+	watermarkBottomRight = "bottom-right"
+	watermarkCenter      = "center"
+
+	// watermarkWidthRatio and watermarkMarginRatio size the watermark
+	// relative to the video, so it looks the same at any resolution.
+	watermarkWidthRatio  = 0.15
+	watermarkMarginRatio = 0.03
+
+	defaultWatermarkOpacity = 0.8
+
+	watermarkUploadLimit = 5 << 20 // 5 MB
+	// watermarkMaxPixels keeps a small file claiming enormous dimensions
+	// from being decoded.
+	watermarkMaxPixels = 4 << 20
+
+	watermarkKeyPrefix = "watermarks/"
+	// originalKeyPrefix holds kept originals, which are never served; see
+	// Video.OriginalKey.
+	originalKeyPrefix = "originals/"
+)
+
+var watermarkPositions = []string{watermarkTopLeft, watermarkTopRight, watermarkBottomLeft, watermarkBottomRight, watermarkCenter}
+
+var errInvalidWatermark = errors.New("invalid watermark")
+
+// watermarkSettings is a watermark as processing burns it in: the global
+// one from the configuration, whose image is a local file, or a user's,
+// whose image is in storage.
+type watermarkSettings struct {
+	imagePath   string
+	imageKey    string
+	imageSHA256 string
+	position    string
+	opacity     float64
+}
+
+func userWatermarkSettings(watermark database.Watermark) watermarkSettings {
+	return watermarkSettings{
+		imageKey:    watermark.ImageURL,
+		imageSHA256: watermark.ImageSHA256,
+		position:    watermark.Position,
+		opacity:     watermark.Opacity,
+	}
+}
+
+// fingerprint identifies how the watermark looks, it changes whenever a
+// video burned with it would come out differently.
+func (w watermarkSettings) fingerprint() string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s %s %.2f", w.imageSHA256, w.position, w.opacity)))
+	return hex.EncodeToString(sum[:])
+}
+
+func checkWatermarkSettings(position string, opacity float64) error {
+	if !slices.Contains(watermarkPositions, position) {
+		return fmt.Errorf("%w: position must be one of top-left, top-right, bottom-left, bottom-right or center", errInvalidWatermark)
+	}
+	if opacity <= 0 || opacity > 1 || math.IsNaN(opacity) {
+		return fmt.Errorf("%w: opacity must be more than 0 and at most 1", errInvalidWatermark)
+	}
+	return nil
+}
+
+// loadGlobalWatermark checks the watermark configured for everyone.
+func loadGlobalWatermark(imagePath, position string, opacity float64) (*watermarkSettings, error) {
+	err := checkWatermarkSettings(position, opacity)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(imagePath)
+	if err != nil {
+		return nil, err
+	}
+	_, err = decodeWatermarkImage(data)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(data)
+	return &watermarkSettings{
+		imagePath:   imagePath,
+		imageSHA256: hex.EncodeToString(sum[:]),
+		position:    position,
+		opacity:     opacity,
+	}, nil
+}
+
+// decodeWatermarkImage checks an uploaded JPEG or PNG and re-encodes it as
+// PNG, which keeps any transparency and drops metadata.
+func decodeWatermarkImage(data []byte) ([]byte, error) {
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || (format != "jpeg" && format != "png") {
+		return nil, fmt.Errorf("%w: image must be a JPEG or PNG", errInvalidWatermark)
+	}
+	if config.Width <= 0 || config.Height <= 0 || config.Width*config.Height > watermarkMaxPixels {
+		return nil, fmt.Errorf("%w: image is %dx%d, too large", errInvalidWatermark, config.Width, config.Height)
+	}
+	decoded, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidWatermark, err)
+	}
+	img := image.NewNRGBA(image.Rect(0, 0, decoded.Bounds().Dx(), decoded.Bounds().Dy()))
+	draw.Draw(img, img.Bounds(), decoded, decoded.Bounds().Min, draw.Src)
+	var encoded bytes.Buffer
+	err = png.Encode(&encoded, img)
+	if err != nil {
+		return nil, err
+	}
+	return encoded.Bytes(), nil
+}
+
+// watermarkFor is the watermark the user's videos get: their own, else the
+// global one. It's nil when neither is set.
+func (cfg *apiConfig) watermarkFor(userID uuid.UUID) (*watermarkSettings, error) {
+	watermark, err := cfg.db.GetWatermark(userID)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get watermark: %w", err)
+	}
+	if watermark.UserID != uuid.Nil {
+		settings := userWatermarkSettings(watermark)
+		return &settings, nil
+	}
+	return cfg.watermark, nil
+}
+
+// watermarkedSourceSHA256 identifies the file that hashed to sourceSum with
+// watermark burned in, so that the same upload is processed once per
+// watermark.
+func watermarkedSourceSHA256(sourceSum string, watermark watermarkSettings) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s watermark %s", sourceSum, watermark.fingerprint())
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// burnWatermark overlays the watermark on the video at filePath, which is
+// width by height once rotated, and encodes the result as an H.264/AAC MP4,
+// returning its path. It stands in for transcodeToMP4.
+func (cfg *apiConfig) burnWatermark(ctx context.Context, videoID uuid.UUID, filePath string, watermark watermarkSettings, width, height int, duration float64) (string, error) {
+	imagePath := watermark.imagePath
+	if imagePath == "" {
+		downloaded, err := cfg.downloadToTemp(ctx, watermark.imageKey, "watermark-*.png")
+		if err != nil {
+			return "", fmt.Errorf("couldn't download watermark image: %w", err)
+		}
+		defer cfg.removeUpload(downloaded)
+		imagePath = downloaded
+	}
+
+	// libx264 wants even dimensions; the height follows the image's aspect.
+	wmWidth := max(2, int(math.Round(float64(width)*watermarkWidthRatio/2))*2)
+	margin := int(math.Round(float64(min(width, height)) * watermarkMarginRatio))
+	filter := fmt.Sprintf("[1:v]format=rgba,colorchannelmixer=aa=%.2f,scale=%d:-2[wm];[0:v:0][wm]overlay=%s,format=yuv420p[v]",
+		watermark.opacity, wmWidth, watermarkOverlayPosition(watermark.position, margin))
+
+	outputPath := filePath + ".watermarked.mp4"
+	err := runFFmpeg(ctx, []string{
+		"-y",
+		"-i", filePath,
+		"-i", imagePath,
+		"-filter_complex", filter,
+		"-map", "[v]",
+		"-map", "0:a:0?",
+		"-c:v", "libx264",
+		"-preset", "medium",
+		"-crf", "20",
+		"-c:a", "aac",
+		"-b:a", "160k",
+		"-f", "mp4",
+		outputPath,
+	}, duration, cfg.events.progressPublisher(videoID, "watermark"))
+	if err != nil {
+		os.Remove(outputPath)
+		return "", err
+	}
+	return outputPath, nil
+}
+
+// watermarkOverlayPosition is the x and y of ffmpeg's overlay filter, where
+// W and H are the video's size and w and h the watermark's.
+func watermarkOverlayPosition(position string, margin int) string {
+	switch position {
+	case watermarkTopLeft:
+		return fmt.Sprintf("x=%d:y=%d", margin, margin)
+	case watermarkTopRight:
+		return fmt.Sprintf("x=W-w-%d:y=%d", margin, margin)
+	case watermarkBottomLeft:
+		return fmt.Sprintf("x=%d:y=H-h-%d", margin, margin)
+	case watermarkCenter:
+		return "x=(W-w)/2:y=(H-h)/2"
+	default:
+		return fmt.Sprintf("x=W-w-%d:y=H-h-%d", margin, margin)
+	}
+}
+
+// keepOriginal stores the upload at filePath, which hashed to sourceSHA256,
+// under originalKeyPrefix unless it's already there, and returns its key.
+// The caller holds a reference to it.
+func (cfg *apiConfig) keepOriginal(ctx context.Context, videoID uuid.UUID, filePath, sourceSHA256 string) (string, error) {
+	blob, err := cfg.db.ReuseBlob(database.BlobKindOriginal, sourceSHA256)
+	if err != nil {
+		return "", fmt.Errorf("couldn't look up blob: %w", err)
+	}
+	if blob.Key != "" {
+		return blob.Key, nil
+	}
+
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return "", err
+	}
+	randomBytes := make([]byte, 32)
+	_, err = rand.Read(randomBytes)
+	if err != nil {
+		return "", fmt.Errorf("error creating random filename: %w", err)
+	}
+	key := originalKeyPrefix + hex.EncodeToString(randomBytes)
+	cfg.events.publish(videoID, videoEvent{Type: videoEventUploading, Stage: "original"})
+	err = cfg.putFile(ctx, filePath, key, "application/octet-stream")
+	if err != nil {
+		return "", fmt.Errorf("couldn't keep original: %w", err)
+	}
+
+	blob, err = cfg.db.AcquireBlob(database.CreateBlobParams{
+		Kind:   database.BlobKindOriginal,
+		SHA256: sourceSHA256,
+		Key:    key,
+		Size:   info.Size(),
+	})
+	if err != nil {
+		cfg.releaseMedia(cfg.mediaRelease(&key))
+		return "", fmt.Errorf("couldn't register blob: %w", err)
+	}
+	// Kept by someone else in the meantime.
+	if blob.Key != key {
+		cfg.releaseMedia(cfg.mediaRelease(&key))
+	}
+	return blob.Key, nil
+}
+
+// fetchProcessingSource downloads what a reprocess job starts from: the
+// video's original if one was kept, otherwise its stored video, which
+// has no watermark then. It returns the file's path, media type and hash;
+// the file is in uploadsRoot, see downloadToTemp.
+func (cfg *apiConfig) fetchProcessingSource(ctx context.Context, video database.Video) (string, string, string, error) {
+	stored := video.OriginalKey
+	if stored == nil {
+		stored = video.VideoURL
+	}
+	if stored == nil {
+		return "", "", "", fmt.Errorf("%w: video has nothing to process", errJobNotRetryable)
+	}
+	key, ok := cfg.objectKey(*stored)
+	if !ok {
+		return "", "", "", fmt.Errorf("%w: video isn't stored in the current storage backend", errJobNotRetryable)
+	}
+
+	filePath, err := cfg.downloadToTemp(ctx, key, "reprocess-*.upload")
+	if err != nil {
+		return "", "", "", err
+	}
+	sourceSHA256, err := hashFile(filePath)
+	if err != nil {
+		cfg.removeUpload(filePath)
+		return "", "", "", err
+	}
+	format, err := cfg.sniffVideoFile(filePath)
+	if err != nil {
+		cfg.removeUpload(filePath)
+		return "", "", "", fmt.Errorf("%w: %v", errJobNotRetryable, err)
+	}
+	return filePath, format.mediaType, sourceSHA256, nil
+}
+
+// reprocessWatermarkedVideos queues every processed video of the user, or
+// of everyone when userID is nil, whose burned in watermark isn't the one
+// it would get now. It returns how many were queued.
+func (cfg *apiConfig) reprocessWatermarkedVideos(userID *uuid.UUID) (int, error) {
+	var videos []database.Video
+	var err error
+	if userID != nil {
+		videos, err = cfg.db.GetVideos(*userID)
+	} else {
+		videos, err = cfg.db.GetAllVideos()
+	}
+	if err != nil {
+		return 0, fmt.Errorf("couldn't load videos: %w", err)
+	}
+
+	watermarks := map[uuid.UUID]*string{}
+	queued := 0
+	for _, video := range videos {
+		if video.ProcessingStatus != database.ProcessingStatusReady || video.VideoURL == nil {
+			continue
+		}
+		if _, ok := cfg.objectKey(*video.VideoURL); !ok {
+			continue
+		}
+		want, ok := watermarks[video.UserID]
+		if !ok {
+			watermark, err := cfg.watermarkFor(video.UserID)
+			if err != nil {
+				return queued, err
+			}
+			if watermark != nil {
+				fingerprint := watermark.fingerprint()
+				want = &fingerprint
+			}
+			watermarks[video.UserID] = want
+		}
+		if sameWatermark(want, video.Watermark) {
+			continue
+		}
+		// A video that already failed to get this watermark keeps what it
+		// has until the watermark changes again.
+		last, err := cfg.db.GetLatestProcessingJob(video.ID)
+		if err != nil {
+			return queued, fmt.Errorf("couldn't get processing job of video %s: %w", video.ID, err)
+		}
+		if last.Reprocess && last.Status == database.JobStatusFailed && sameWatermark(want, last.Watermark) {
+			continue
+		}
+
+		err = cfg.enqueueReprocessing(video, want)
+		if err != nil {
+			return queued, fmt.Errorf("couldn't queue video %s: %w", video.ID, err)
+		}
+		queued++
+	}
+	return queued, nil
+}
+
+// sameWatermark compares watermark fingerprints, nil meaning none.
+func sameWatermark(a, b *string) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return *a == *b
+}
+
+// enqueueReprocessing queues the video to be processed again from its
+// original, see fetchProcessingSource, to get the watermark with the given
+// fingerprint.
+func (cfg *apiConfig) enqueueReprocessing(video database.Video, watermark *string) error {
+	_, err := cfg.db.CreateProcessingJob(database.CreateProcessingJobParams{
+		VideoID:   video.ID,
+		Reprocess: true,
+		Watermark: watermark,
+	})
+	if err != nil {
+		return err
+	}
+	err = cfg.db.SetVideoProcessingStatus(video.ID, database.ProcessingStatusPending, nil)
+	if err != nil {
+		return err
+	}
+	cfg.events.publish(video.ID, videoEvent{Type: videoEventQueued})
+	cfg.processing.notify()
+	return nil
+}
+
+// putWatermarkImage stores a user's watermark image, with a new name every
+// time so nothing serves a cached old version.
+func (cfg *apiConfig) putWatermarkImage(ctx context.Context, userID uuid.UUID, data []byte) (string, error) {
+	randomBytes := make([]byte, 16)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", fmt.Errorf("error creating random filename: %w", err)
+	}
+	key := watermarkKeyPrefix + userID.String() + "/" + hex.EncodeToString(randomBytes) + ".png"
+	err = cfg.storage.Put(ctx, key, bytes.NewReader(data), storage.PutOptions{ContentType: "image/png"})
+	if err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+// requeueForWatermark is reprocessWatermarkedVideos for callers that can't
+// do anything about a failure but log it.
+func (cfg *apiConfig) requeueForWatermark(userID *uuid.UUID) int {
+	queued, err := cfg.reprocessWatermarkedVideos(userID)
+	if err != nil {
+		log.Printf("Couldn't queue videos to get their watermark updated: %v", err)
+	}
+	return queued
+}